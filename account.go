@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	mailer "github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mail"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/validation"
+	"github.com/google/uuid"
+)
+
+// sendUserToken creates a single-use token for purpose and mails a link
+// to the app carrying it to email.
+func (cfg *apiConfig) sendUserToken(ctx context.Context, userID uuid.UUID, email, purpose string) error {
+	token, hash, err := auth.MakeOneTimeToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := cfg.emailVerificationTTL
+	param, subject, intro := "verify_email_token", "Confirm your email address",
+		"Confirm your email address for Tubely by opening this link:"
+	if purpose == database.TokenPurposePasswordReset {
+		ttl = cfg.passwordResetTTL
+		param, subject, intro = "password_reset_token", "Reset your password",
+			"Someone asked to reset the password of your Tubely account. If it was you, open this link to choose a new one:"
+	}
+
+	err = cfg.db.CreateUserToken(ctx, database.CreateUserTokenParams{
+		TokenHash: hash,
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("could not save token: %w", err)
+	}
+
+	link := cfg.publicBaseURL + "/app/?" + url.Values{param: {token}}.Encode()
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: subject,
+		Body:    fmt.Sprintf("%s\n\n%s\n\nThe link expires in %s. If you didn't ask for this, you can ignore this email.\n", intro, link, ttl),
+	})
+}
+
+// handlerEmailVerificationRequest mails the caller a new link to confirm
+// their email address.
+func (cfg *apiConfig) handlerEmailVerificationRequest(w http.ResponseWriter, r *http.Request) {
+	user := cfg.authenticatedUser(w, r)
+	if user == nil {
+		return
+	}
+	if user.EmailVerifiedAt != nil {
+		respondWithErrorCode(w, r, http.StatusConflict, codeEmailAlreadyVerified, "Email address is already verified", nil)
+		return
+	}
+
+	if err := cfg.sendUserToken(r.Context(), user.ID, user.Email, database.TokenPurposeVerifyEmail); err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't send verification email", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerEmailVerificationConfirm consumes a verification token. It needs
+// no access token, since the link may be opened on another device.
+func (cfg *apiConfig) handlerEmailVerificationConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+
+	token, err := cfg.db.ConsumeUserToken(r.Context(), auth.HashToken(params.Token), database.TokenPurposeVerifyEmail)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't check token", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", token.UserID.String()))
+
+	verified, err := cfg.db.MarkEmailVerified(r.Context(), token.UserID, token.Email)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+	if !verified {
+		respondWithErrorCode(w, r, http.StatusBadRequest, codeInvalidToken, "Email address has changed since the link was sent", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPasswordResetRequest mails a reset link if the address belongs to
+// an account. It responds the same either way so it can't be used to find
+// out which addresses are registered.
+func (cfg *apiConfig) handlerPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if err == nil {
+		logging.AddAttrs(r.Context(), slog.String("user_id", user.ID.String()))
+		if err := cfg.sendUserToken(r.Context(), user.ID, user.Email, database.TokenPurposePasswordReset); err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Couldn't send password reset email", err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handlerPasswordResetConfirm sets a new password using a reset token and
+// signs the user out everywhere.
+func (cfg *apiConfig) handlerPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	var errs validation.Errors
+	errs.Check("password", validation.Required(params.Password), validation.Password(params.Password))
+	if err := errs.Err(); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	token, err := cfg.db.ConsumeUserToken(r.Context(), auth.HashToken(params.Token), database.TokenPurposePasswordReset)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithErrorCode(w, r, http.StatusBadRequest, codeInvalidToken, "Invalid or expired token", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't check token", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", token.UserID.String()))
+
+	if err := cfg.setPassword(r.Context(), token.UserID, params.Password); err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't reset password", err)
+		return
+	}
+	// Whoever holds the reset link controls the account now, so earlier
+	// failed sign-ins shouldn't keep it locked.
+	cfg.recordLoginAttempt(r.Context(), r, &token.UserID, token.Email, database.LoginPasswordReset)
+	// Other reset links sent earlier must not work after this one.
+	if err := cfg.db.DeleteUserTokens(r.Context(), token.UserID, database.TokenPurposePasswordReset); err != nil {
+		slog.ErrorContext(r.Context(), "could not delete password reset tokens", "error", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword replaces the user's password and revokes their refresh
+// tokens, so sessions opened with the old password end.
+func (cfg *apiConfig) setPassword(ctx context.Context, userID uuid.UUID, password string) error {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := cfg.db.UpdateUserPassword(ctx, userID, hash); err != nil {
+		return err
+	}
+	return cfg.db.RevokeUserRefreshTokens(ctx, userID)
+}
+
+// authenticatedUser loads the user the request's access token belongs to,
+// responding with an error and returning nil if there isn't one.
+func (cfg *apiConfig) authenticatedUser(w http.ResponseWriter, r *http.Request) *database.User {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return nil
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return nil
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusUnauthorized, "User no longer exists", nil)
+		return nil
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user", err)
+		return nil
+	}
+	return user
+}
+
+// checkPassword responds with 403 and returns false unless password is the
+// user's current one. Sensitive account changes require it so a stolen
+// access token isn't enough to take over an account.
+func checkPassword(w http.ResponseWriter, r *http.Request, user *database.User, password string) bool {
+	match, err := auth.CheckPasswordHash(password, user.Password)
+	if err != nil || !match {
+		respondWithErrorCode(w, r, http.StatusForbidden, codeIncorrectPassword, "Incorrect password", err)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) handlerUserGet(w http.ResponseWriter, r *http.Request) {
+	user := cfg.authenticatedUser(w, r)
+	if user == nil {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// handlerUserEmailUpdate changes the caller's email address and mails a
+// verification link to the new one.
+func (cfg *apiConfig) handlerUserEmailUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+
+	user := cfg.authenticatedUser(w, r)
+	if user == nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	var errs validation.Errors
+	errs.Check("email", validation.Required(params.Email), validation.Email(params.Email))
+	if err := errs.Err(); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+	if !checkPassword(w, r, user, params.Password) {
+		return
+	}
+	if params.Email == user.Email {
+		respondWithJSON(w, http.StatusOK, user)
+		return
+	}
+
+	_, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't check email", err)
+		return
+	}
+	if err == nil {
+		respondWithErrorCode(w, r, http.StatusConflict, codeEmailTaken, "Email address is already in use", nil)
+		return
+	}
+
+	if err := cfg.db.UpdateUserEmail(r.Context(), user.ID, params.Email); err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't update email", err)
+		return
+	}
+	// Links sent to the old address must not verify the new one.
+	if err := cfg.db.DeleteUserTokens(r.Context(), user.ID, database.TokenPurposeVerifyEmail); err != nil {
+		slog.ErrorContext(r.Context(), "could not delete verification tokens", "error", err)
+	}
+	if err := cfg.sendUserToken(r.Context(), user.ID, params.Email, database.TokenPurposeVerifyEmail); err != nil {
+		slog.ErrorContext(r.Context(), "could not send verification email", "error", err)
+	}
+
+	user.Email = params.Email
+	user.EmailVerifiedAt = nil
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// handlerUserPasswordUpdate changes the caller's password and signs them
+// out of every other session.
+func (cfg *apiConfig) handlerUserPasswordUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+
+	user := cfg.authenticatedUser(w, r)
+	if user == nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	var errs validation.Errors
+	errs.Check("new_password", validation.Required(params.NewPassword), validation.Password(params.NewPassword))
+	if err := errs.Err(); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+	if !checkPassword(w, r, user, params.OldPassword) {
+		return
+	}
+
+	if err := cfg.setPassword(r.Context(), user.ID, params.NewPassword); err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't change password", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerUserDelete deletes the caller's account with all their videos,
+// and the stored files nothing else references.
+func (cfg *apiConfig) handlerUserDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	user := cfg.authenticatedUser(w, r)
+	if user == nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	if !checkPassword(w, r, user, params.Password) {
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	if err := cfg.db.DeleteUser(r.Context(), user.ID); err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't delete user", err)
+		return
+	}
+	for _, video := range videos {
+		cfg.releaseObject(r.Context(), video.Thumbnail)
+		cfg.releaseObject(r.Context(), video.VideoFile)
+	}
+
+	slog.InfoContext(r.Context(), "user deleted", "videos", len(videos))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,4 +1,5 @@
 document.addEventListener('DOMContentLoaded', async () => {
+  await handleEmailLinks();
   const token = localStorage.getItem('token');
 
   if (token) {
@@ -24,6 +25,7 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
 async function createVideoDraft() {
   const title = document.getElementById('video-title').value;
   const description = document.getElementById('video-description').value;
+  const visibility = document.getElementById('video-private').checked ? 'private' : 'public';
 
   try {
     const res = await fetch('/api/videos', {
@@ -32,11 +34,11 @@ async function createVideoDraft() {
         'Content-Type': 'application/json',
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
-      body: JSON.stringify({ title, description }),
+      body: JSON.stringify({ title, description, visibility }),
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to create video draft: ${data.error}`);
+      throw new Error(`Failed to create video draft: ${errorMessage(data)}`);
     }
 
     const videoID = data.id;
@@ -63,7 +65,7 @@ async function login() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to login: ${data.error}`);
+      throw new Error(`Failed to login: ${errorMessage(data)}`);
     }
 
     if (data.token) {
@@ -93,7 +95,7 @@ async function signup() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to create user: ${data.error}`);
+      throw new Error(`Failed to create user: ${errorMessage(data)}`);
     }
     console.log('User created!');
     await login();
@@ -102,6 +104,73 @@ async function signup() {
   }
 }
 
+// handleEmailLinks completes email verification and password resets for
+// links mailed by the server, which open the app with a token parameter.
+async function handleEmailLinks() {
+  const params = new URLSearchParams(window.location.search);
+  const verifyToken = params.get('verify_email_token');
+  const resetToken = params.get('password_reset_token');
+  if (!verifyToken && !resetToken) {
+    return;
+  }
+  window.history.replaceState(null, '', window.location.pathname);
+
+  try {
+    if (verifyToken) {
+      await postJSON('/api/email_verification/confirm', { token: verifyToken });
+      alert('Email address verified!');
+      return;
+    }
+    const password = prompt('Choose a new password');
+    if (!password) {
+      return;
+    }
+    await postJSON('/api/password_reset/confirm', { token: resetToken, password });
+    localStorage.removeItem('token');
+    alert('Password changed, please log in again.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function requestPasswordReset() {
+  const email = document.getElementById('email').value;
+  if (!email) {
+    alert('Enter your email address first.');
+    return;
+  }
+  try {
+    await postJSON('/api/password_reset', { email });
+    alert('If that address has an account, a reset link is on its way.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function postJSON(url, body) {
+  const res = await fetch(url, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify(body),
+  });
+  if (!res.ok) {
+    const data = await res.json();
+    throw new Error(errorMessage(data));
+  }
+}
+
+// errorMessage describes an API error response, listing the rejected
+// fields of a validation error.
+function errorMessage(data) {
+  if (data.code !== 'validation_failed') {
+    return data.message;
+  }
+  const fields = data.details.map((f) => `${f.field} ${f.message}`);
+  return `${data.message}: ${fields.join(', ')}`;
+}
+
 function logout() {
   localStorage.removeItem('token');
   document.getElementById('auth-section').style.display = 'block';
@@ -139,7 +208,7 @@ async function uploadThumbnail(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload thumbnail. Error: ${data.error}`);
+      throw new Error(`Failed to upload thumbnail. Error: ${errorMessage(data)}`);
     }
 
     await res.json();
@@ -161,6 +230,7 @@ async function uploadVideoFile(videoID) {
 
   uploadBtnSelector = 'upload-video-btn';
   setUploadButtonState(true, uploadBtnSelector);
+  const progress = watchUploadProgress(videoID);
 
   try {
     const res = await fetch(`/api/video_upload/${videoID}`, {
@@ -172,7 +242,7 @@ async function uploadVideoFile(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to upload video file. Error: ${errorMessage(data)}`);
     }
 
     console.log('Video uploaded!');
@@ -181,9 +251,41 @@ async function uploadVideoFile(videoID) {
     alert(`Error: ${error.message}`);
   }
 
+  progress.close();
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+const uploadStageLabels = {
+  received: 'Upload received',
+  probing: 'Reading video metadata...',
+  remuxing: 'Optimising for streaming...',
+  uploading: 'Saving video...',
+  done: 'Done!',
+  failed: 'Upload failed',
+};
+
+// watchUploadProgress shows the server's processing stages for a video
+// upload. EventSource can't send headers, so the token goes in the URL.
+function watchUploadProgress(videoID) {
+  const status = document.getElementById('upload-progress');
+  status.textContent = 'Uploading...';
+
+  const token = encodeURIComponent(localStorage.getItem('token'));
+  const source = new EventSource(`/api/videos/${videoID}/progress?token=${token}`);
+  source.addEventListener('progress', (event) => {
+    const progress = JSON.parse(event.data);
+    let text = uploadStageLabels[progress.stage] || progress.stage;
+    if (progress.stage === 'uploading' && progress.total) {
+      text += ` ${Math.floor((100 * (progress.bytes || 0)) / progress.total)}%`;
+    }
+    status.textContent = text;
+    if (progress.stage === 'done' || progress.stage === 'failed') {
+      source.close();
+    }
+  });
+  return source;
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -196,7 +298,7 @@ async function getVideos() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
+      throw new Error(`Failed to get videos. Error: ${errorMessage(data)}`);
     }
 
     const videos = await res.json();
@@ -241,6 +343,7 @@ async function getVideo(videoID) {
       throw new Error('Failed to get video.');
     }
 
+    currentVideoETag = res.headers.get('ETag');
     const video = await res.json();
     viewVideo(video);
   } catch (error) {
@@ -249,6 +352,20 @@ async function getVideo(videoID) {
 }
 
 let currentVideo = null;
+// currentVideoETag is sent as If-Match when editing, so edits made
+// elsewhere since the video was loaded aren't overwritten.
+let currentVideoETag = null;
+
+// Media elements can't send an Authorization header, so private media is
+// requested with the access token in the query string.
+function mediaURL(video, url) {
+  if (video.visibility !== 'private') {
+    return url;
+  }
+  const u = new URL(url, window.location.origin);
+  u.searchParams.set('token', localStorage.getItem('token'));
+  return u.toString();
+}
 
 function viewVideo(video) {
   currentVideo = video;
@@ -261,7 +378,7 @@ function viewVideo(video) {
     thumbnailImg.style.display = 'none';
   } else {
     thumbnailImg.style.display = 'block';
-    thumbnailImg.src = video.thumbnail_url;
+    thumbnailImg.src = mediaURL(video, video.thumbnail_url);
   }
 
   const videoPlayer = document.getElementById('video-player');
@@ -270,12 +387,53 @@ function viewVideo(video) {
       videoPlayer.style.display = 'none';
     } else {
       videoPlayer.style.display = 'block';
-      videoPlayer.src = video.video_url;
+      videoPlayer.src = mediaURL(video, video.video_url);
       videoPlayer.load();
     }
   }
 }
 
+async function editVideo() {
+  if (!currentVideo) {
+    alert('No video selected for editing.');
+    return;
+  }
+  const title = prompt('Title', currentVideo.title);
+  if (title === null) {
+    return;
+  }
+  const description = prompt('Description', currentVideo.description);
+  if (description === null) {
+    return;
+  }
+
+  try {
+    const res = await fetch(`/api/videos/${currentVideo.id}`, {
+      method: 'PATCH',
+      headers: {
+        'Content-Type': 'application/json',
+        'If-Match': currentVideoETag,
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+      body: JSON.stringify({ title, description }),
+    });
+    const data = await res.json();
+    if (res.status === 412) {
+      alert('The video was changed elsewhere, showing the latest version.');
+      await getVideo(currentVideo.id);
+      return;
+    }
+    if (!res.ok) {
+      throw new Error(`Failed to update video: ${errorMessage(data)}`);
+    }
+    currentVideoETag = res.headers.get('ETag');
+    viewVideo(data);
+    await getVideos();
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
 async function deleteVideo() {
   if (!currentVideo) {
     alert('No video selected for deletion.');
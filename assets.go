@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +12,37 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// urlResolver derives public URLs from where an object is stored, so the
+// CDN, bucket or asset origin can change without rewriting stored videos.
+type urlResolver struct {
+	assetsBaseURL string
+	s3Bucket      string
+	s3Region      string
+	s3CDNDomain   string
+}
+
+func (res urlResolver) URL(obj database.StoredObject) string {
+	switch obj.Backend {
+	case database.BackendS3:
+		if obj.Bucket == "" || obj.Bucket == res.s3Bucket {
+			return "https://" + res.s3CDNDomain + "/" + obj.Key
+		}
+		return "https://" + obj.Bucket + ".s3." + res.s3Region + ".amazonaws.com/" + obj.Key
+	default:
+		return res.assetsBaseURL + "/" + obj.Key
+	}
+}
+
+// resolveURLs fills in the public URLs of a video's stored files. It must
+// be called on every video before it is returned to a client.
+func (cfg *apiConfig) resolveURLs(video *database.Video) {
+	if video.Thumbnail != nil {
+		tnURL := cfg.urls.URL(*video.Thumbnail)
+		video.ThumbnailURL = &tnURL
+	}
+	if video.VideoFile != nil {
+		videoURL := cfg.urls.URL(*video.VideoFile)
+		video.VideoURL = &videoURL
+	}
+}
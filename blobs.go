@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// hashingWriter hashes everything written through it.
+type hashingWriter struct {
+	w    io.Writer
+	h    hash.Hash
+	size int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, h: sha256.New()}
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.size += int64(n)
+	return n, err
+}
+
+// Sum returns the hex SHA-256 of the bytes written so far.
+func (hw *hashingWriter) Sum() string {
+	return hex.EncodeToString(hw.h.Sum(nil))
+}
+
+// hashFile returns the hex SHA-256 and size of f's content, leaving f
+// positioned at its start.
+func hashFile(f *os.File) (string, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	hw := newHashingWriter(io.Discard)
+	if _, err := io.Copy(hw, f); err != nil {
+		return "", 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	return hw.Sum(), hw.size, nil
+}
+
+// storeBlob takes a reference to the blob at params, calling store to
+// write the file unless another reference has already stored it. The
+// reference is taken first so a concurrent release of the last other
+// reference can't delete the file while this upload counts on it; if store
+// fails the reference is dropped again. Uploads racing on the same content
+// each store it: keys are derived from the content, so the writes agree,
+// and none of them relies on another that may still fail.
+func (cfg *apiConfig) storeBlob(ctx context.Context, params database.CreateBlobParams, store func() error) error {
+	mustStore, err := cfg.db.AcquireBlob(ctx, params)
+	if err != nil {
+		return err
+	}
+	if !mustStore {
+		slog.InfoContext(ctx, "reusing stored blob", "sha256", params.SHA256, "key", params.Key)
+		return nil
+	}
+	if err := store(); err != nil {
+		cfg.releaseObject(context.WithoutCancel(ctx), &params.StoredObject)
+		return err
+	}
+	// Failing to mark the blob only means later uploads store it again.
+	if err := cfg.db.MarkBlobStored(context.WithoutCancel(ctx), params.StoredObject); err != nil {
+		slog.ErrorContext(ctx, "could not mark blob stored", "key", params.Key, "error", err)
+	}
+	return nil
+}
+
+// releaseObject drops a video's reference to obj and deletes the file once
+// nothing references it. Failures are logged rather than returned: by the
+// time an object is released the video no longer points at it, so the
+// worst outcome is an orphaned file.
+func (cfg *apiConfig) releaseObject(ctx context.Context, obj *database.StoredObject) {
+	if obj == nil {
+		return
+	}
+	unreferenced, err := cfg.db.ReleaseBlob(ctx, *obj)
+	if err != nil {
+		slog.ErrorContext(ctx, "could not release blob", "key", obj.Key, "error", err)
+		return
+	}
+	if !unreferenced {
+		return
+	}
+	if err := cfg.deleteObject(ctx, *obj); err != nil {
+		slog.ErrorContext(ctx, "could not delete unreferenced object", "backend", obj.Backend, "key", obj.Key, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "deleted unreferenced object", "backend", obj.Backend, "key", obj.Key)
+}
+
+func (cfg *apiConfig) deleteObject(ctx context.Context, obj database.StoredObject) error {
+	switch obj.Backend {
+	case database.BackendLocal:
+		err := os.Remove(filepath.Join(cfg.assetsRoot, filepath.FromSlash(obj.Key)))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	case database.BackendS3:
+		bucket := obj.Bucket
+		if bucket == "" {
+			bucket = cfg.s3Bucket
+		}
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &obj.Key,
+		})
+		return err
+	default:
+		return fmt.Errorf("unknown storage backend %q", obj.Backend)
+	}
+}
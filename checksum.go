@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+)
+
+// Headers carrying client digests of the uploaded file, base64 encoded as
+// in Content-MD5. They describe the file part, not the multipart body.
+const (
+	headerUploadMD5    = "X-Upload-Content-MD5"
+	headerUploadSHA256 = "X-Upload-Content-SHA256"
+)
+
+var errChecksumMismatch = errors.New("upload does not match the supplied checksum")
+
+// uploadChecksums holds the digests a client sent with an upload. Either
+// may be nil.
+type uploadChecksums struct {
+	md5    []byte
+	sha256 []byte
+}
+
+func parseUploadChecksums(h http.Header) (uploadChecksums, error) {
+	var sums uploadChecksums
+	var err error
+	if sums.md5, err = decodeDigest(h, headerUploadMD5, md5.Size); err != nil {
+		return uploadChecksums{}, err
+	}
+	if sums.sha256, err = decodeDigest(h, headerUploadSHA256, sha256.Size); err != nil {
+		return uploadChecksums{}, err
+	}
+	return sums, nil
+}
+
+func decodeDigest(h http.Header, name string, size int) ([]byte, error) {
+	value := h.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	digest, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(digest) != size {
+		return nil, fmt.Errorf("%s must be a base64 encoded %d byte digest", name, size)
+	}
+	return digest, nil
+}
+
+// verifier returns a writer that checks everything written to it against
+// the client's digests.
+func (sums uploadChecksums) verifier() *checksumVerifier {
+	v := &checksumVerifier{want: sums}
+	if sums.md5 != nil {
+		v.md5 = md5.New()
+	}
+	if sums.sha256 != nil {
+		v.sha256 = sha256.New()
+	}
+	return v
+}
+
+type checksumVerifier struct {
+	want   uploadChecksums
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func (v *checksumVerifier) Write(p []byte) (int, error) {
+	if v.md5 != nil {
+		v.md5.Write(p)
+	}
+	if v.sha256 != nil {
+		v.sha256.Write(p)
+	}
+	return len(p), nil
+}
+
+// verify reports errChecksumMismatch if the bytes written don't match.
+func (v *checksumVerifier) verify() error {
+	if v.md5 != nil && !bytes.Equal(v.md5.Sum(nil), v.want.md5) {
+		return fmt.Errorf("%w: MD5 differs", errChecksumMismatch)
+	}
+	if v.sha256 != nil && !bytes.Equal(v.sha256.Sum(nil), v.want.sha256) {
+		return fmt.Errorf("%w: SHA-256 differs", errChecksumMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Error codes are sent in the "code" field of every error response. Unlike
+// messages they never change, so clients can branch on them. The list is
+// documented in README.md; keep the two in sync.
+const (
+	// Generic codes, one per status; see errorCodeForStatus.
+	codeInvalidRequest     = "invalid_request"
+	codeUnauthenticated    = "unauthenticated"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codePreconditionFailed = "precondition_failed"
+	codePayloadTooLarge    = "payload_too_large"
+	codeUnsupportedMedia   = "unsupported_media_type"
+	codeValidationFailed   = "validation_failed"
+	codeRateLimited        = "rate_limited"
+	codeInternal           = "internal_error"
+	codeUnavailable        = "unavailable"
+
+	// Specific codes for failures a client may want to handle differently
+	// from others with the same status.
+	codeInvalidCredentials   = "invalid_credentials"
+	codeIncorrectPassword    = "incorrect_password"
+	codeInvalidToken         = "invalid_token"
+	codeAccountLocked        = "account_locked"
+	codeEmailTaken           = "email_taken"
+	codeEmailAlreadyVerified = "email_already_verified"
+	codeChecksumMismatch     = "checksum_mismatch"
+)
+
+// apiError is the body of every error response.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details holds extra information for some codes, such as the
+	// rejected fields of a validation_failed error.
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return codeInvalidRequest
+	case http.StatusUnauthorized:
+		return codeUnauthenticated
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusPreconditionFailed:
+		return codePreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return codePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return codeUnsupportedMedia
+	case http.StatusUnprocessableEntity:
+		return codeValidationFailed
+	case http.StatusTooManyRequests:
+		return codeRateLimited
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	if status >= 500 {
+		return codeInternal
+	}
+	return codeInvalidRequest
+}
+
+// respondWithError responds with the generic error code for status.
+func respondWithError(w http.ResponseWriter, r *http.Request, status int, msg string, err error) {
+	respondWithAPIError(w, r, status, apiError{Code: errorCodeForStatus(status), Message: msg}, err)
+}
+
+// respondWithErrorCode responds with a specific error code.
+func respondWithErrorCode(w http.ResponseWriter, r *http.Request, status int, code, msg string, err error) {
+	respondWithAPIError(w, r, status, apiError{Code: code, Message: msg}, err)
+}
+
+// respondWithAPIError logs err, which is never sent to the client, and
+// responds with apiErr tagged with the request ID.
+func respondWithAPIError(w http.ResponseWriter, r *http.Request, status int, apiErr apiError, err error) {
+	ctx := r.Context()
+	if status > 499 {
+		slog.ErrorContext(ctx, "responding with 5XX error", "status", status, "code", apiErr.Code, "message", apiErr.Message, "error", err)
+	} else if err != nil {
+		slog.InfoContext(ctx, "responding with 4XX error", "status", status, "code", apiErr.Code, "message", apiErr.Message, "error", err)
+	}
+	apiErr.RequestID = requestIDFromContext(ctx)
+	respondWithJSON(w, status, apiErr)
+}
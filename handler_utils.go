@@ -1,26 +1,26 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
-	"log"
-	"math"
+	"log/slog"
 	"mime"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/tracing"
 	"github.com/google/uuid"
 )
 
@@ -33,197 +33,298 @@ func validateRequest(cfg *apiConfig, w http.ResponseWriter, r *http.Request) (uu
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithError(w, r, http.StatusBadRequest, "Invalid ID", err)
 		return uuid.UUID{}, uuid.UUID{}, err
 	}
+	logging.AddAttrs(r.Context(), slog.String("video_id", videoID.String()))
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return uuid.UUID{}, uuid.UUID{}, err
 	}
 
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return uuid.UUID{}, uuid.UUID{}, err
 	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
 
 	return videoID, userID, nil
 }
 
-func parseUploadReq(w http.ResponseWriter, r *http.Request, key string) (string, multipart.File, error) {
+// parseUploadReq reads the multipart stream up to the part named key and
+// returns that part unbuffered, so the caller copies the upload straight to
+// its destination instead of having it spooled to disk first. Parts before
+// it are skipped.
+func parseUploadReq(w http.ResponseWriter, r *http.Request, key string) (string, io.Reader, error) {
 	validMediaTypes := make(map[string]struct{})
+	var invalidMediaTypeMsg string
 	switch key {
 	case "thumbnail":
 		validMediaTypes["image/png"] = struct{}{}
 		validMediaTypes["image/jpeg"] = struct{}{}
+		invalidMediaTypeMsg = "Thumbnail media type must be either image/jpeg or image/png"
 	case "video":
 		validMediaTypes["video/mp4"] = struct{}{}
+		invalidMediaTypeMsg = "Video media type must be video/mp4"
 	default:
 		panic("Invalid key for Content-Type header")
 	}
 
-	const maxMemory = 10 * MiB
-	if err := r.ParseMultipartForm(maxMemory); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse multipart form", err)
-		return "", nil, err
-	}
-
-	multipartFile, header, err := r.FormFile(key)
+	reader, err := r.MultipartReader()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't form file the request", err)
+		respondWithError(w, r, http.StatusBadRequest, "Couldn't parse multipart form", err)
 		return "", nil, err
 	}
 
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
-	if _, ok := validMediaTypes[mediaType]; !ok {
-		err = errors.New("Invalid media type")
-		respondWithError(w, http.StatusBadRequest, "Thumbnail media type must be either image/jpeg or image/png", err)
-		return "", nil, err
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			err = fmt.Errorf("no %q part in form", key)
+			respondWithError(w, r, http.StatusBadRequest, "Missing "+key+" file", err)
+			return "", nil, err
+		}
+		if err != nil {
+			respondWithError(w, r, uploadErrorStatus(err, http.StatusBadRequest), "Couldn't parse multipart form", err)
+			return "", nil, err
+		}
+		if part.FormName() != key {
+			continue
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if _, ok := validMediaTypes[mediaType]; !ok {
+			err = errors.New("Invalid media type")
+			respondWithError(w, r, http.StatusUnsupportedMediaType, invalidMediaTypeMsg, err)
+			return "", nil, err
+		}
+
+		return mediaType, part, nil
 	}
+}
 
-	return mediaType, multipartFile, nil
+// uploadErrorStatus returns 413 if err comes from exceeding the request
+// body limit and fallback otherwise.
+func uploadErrorStatus(err error, fallback int) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return fallback
 }
 
-func getVideoMetadata(cfg *apiConfig, w http.ResponseWriter, videoID, userID uuid.UUID) (database.Video, error) {
-	metadata, err := cfg.db.GetVideo(videoID)
+func getVideoMetadata(cfg *apiConfig, w http.ResponseWriter, r *http.Request, videoID, userID uuid.UUID) (database.Video, error) {
+	metadata, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", nil)
+		return metadata, err
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't find image metdata in db", err)
-	} else if metadata.UserID != userID {
-		err = errors.New("User ID from request does not match video owner ID")
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get video", err)
+		return metadata, err
+	}
+	if metadata.UserID != userID {
+		err = errors.New("user ID from request does not match video owner ID")
+		slog.WarnContext(r.Context(), "rejected upload for video owned by another user")
+		respondWithError(w, r, http.StatusForbidden, "You can't modify this video", err)
+		return metadata, err
 	}
 
-	return metadata, err
+	return metadata, nil
 }
 
-func (cfg *apiConfig) updateThumbnail(multipartFile multipart.File, mediaType string, metadata database.Video) error {
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
+func (cfg *apiConfig) updateThumbnail(ctx context.Context, upload io.Reader, mediaType string, checksums uploadChecksums, metadata *database.Video) error {
+	// Write to a temporary name first; the final name is the content hash.
+	file, err := os.CreateTemp(cfg.assetsRoot, ".thumbnail-*")
+	if err != nil {
 		return err
 	}
-	randEncoded := base64.RawURLEncoding.EncodeToString(randBytes)
-
-	fileExt := strings.Split(mediaType, "/")[1]
-	fileName := randEncoded + "." + fileExt
-	thumbnailFilePath := filepath.Join(cfg.assetsRoot, fileName)
+	defer os.Remove(file.Name())
 
-	file, err := os.Create(thumbnailFilePath)
+	hw := newHashingWriter(file)
+	verifier := checksums.verifier()
+	_, err = io.Copy(io.MultiWriter(hw, verifier), upload)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
+	if err := verifier.verify(); err != nil {
+		return err
+	}
+	metrics.UploadBytes.WithLabelValues("thumbnail").Add(float64(hw.size))
 
-	if _, err = io.Copy(file, multipartFile); err != nil {
+	hash := hw.Sum()
+	fileExt := strings.Split(mediaType, "/")[1]
+	blob := database.CreateBlobParams{
+		StoredObject: database.StoredObject{
+			Backend: database.BackendLocal,
+			Key:     hash + "." + fileExt,
+		},
+		SHA256: hash,
+		Size:   hw.size,
+	}
+	err = cfg.storeBlob(ctx, blob, func() error {
+		return os.Rename(file.Name(), filepath.Join(cfg.assetsRoot, blob.Key))
+	})
+	if err != nil {
 		return err
 	}
 
-	tnURL := "http://localhost:" + cfg.port + "/assets/" + fileName
-	metadata.ThumbnailURL = &tnURL
-	cfg.db.UpdateVideo(metadata)
+	// The object is stored; record it even if the client has gone away,
+	// or it would be orphaned.
+	ctx = context.WithoutCancel(ctx)
+	previous := metadata.Thumbnail
+	metadata.Thumbnail = &blob.StoredObject
+	metadata.ThumbnailSHA256 = &blob.SHA256
+	metadata.ThumbnailURL = nil
+	if err := cfg.db.UpdateVideo(ctx, metadata); err != nil {
+		cfg.releaseObject(ctx, &blob.StoredObject)
+		return err
+	}
+	cfg.releaseObject(ctx, previous)
 
-	log.Println("Info: thumbnail URL updated in db")
+	slog.InfoContext(ctx, "thumbnail key updated in db", "thumbnail_key", blob.Key)
 	return nil
 }
 
-func (cfg *apiConfig) updateVideo(tempFile *os.File, orientation, mediaType string, metadata database.Video) error {
-	randBytes := make([]byte, 32)
-	if _, err := rand.Read(randBytes); err != nil {
+func (cfg *apiConfig) updateVideo(ctx context.Context, tempFile *os.File, orientation, mediaType string, metadata *database.Video) error {
+	hash, size, err := hashFile(tempFile)
+	if err != nil {
+		return fmt.Errorf("could not hash video: %w", err)
+	}
+	digest, err := hex.DecodeString(hash)
+	if err != nil {
 		return err
 	}
-	s3Key := orientation + "/" + base64.RawURLEncoding.EncodeToString(randBytes) + ".ext"
+	blob := database.CreateBlobParams{
+		StoredObject: database.StoredObject{
+			Backend: database.BackendS3,
+			Bucket:  cfg.s3Bucket,
+			Key:     orientation + "/" + hash + ".mp4",
+		},
+		SHA256: hash,
+		Size:   size,
+	}
 
-	if _, err := cfg.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &s3Key,
-		Body:        tempFile,
-		ContentType: &mediaType,
-	}); err != nil {
+	store := func() error {
+		uploadCtx, cancel := context.WithTimeout(ctx, cfg.s3UploadTimeout)
+		defer cancel()
+
+		body := &progressReader{
+			r:     tempFile,
+			total: size,
+			publish: func(ev progressEvent) {
+				cfg.progress.publish(metadata.ID, ev)
+			},
+		}
+
+		// S3 recomputes the digest and rejects the upload if it differs.
+		checksum := base64.StdEncoding.EncodeToString(digest)
+		uploadCtx, span := startStage(uploadCtx, "upload.s3_put_object")
+		_, err := cfg.s3Client.PutObject(uploadCtx, &s3.PutObjectInput{
+			Bucket:            &cfg.s3Bucket,
+			Key:               &blob.Key,
+			Body:              body,
+			ContentLength:     &size,
+			ContentType:       &mediaType,
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+			ChecksumSHA256:    &checksum,
+		})
+		tracing.End(span, err)
+		return err
+	}
+	if cfg.videoBackend == database.BackendLocal {
+		// Local videos are served by handlerAssetGet instead of S3.
+		blob.Backend = database.BackendLocal
+		blob.Bucket = ""
+		store = func() error {
+			dst := filepath.Join(cfg.assetsRoot, filepath.FromSlash(blob.Key))
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			return copyFile(dst, tempFile)
+		}
+	}
+	cfg.progress.publish(metadata.ID, progressEvent{Stage: stageUploading, Total: size})
+	if err := cfg.storeBlob(ctx, blob, store); err != nil {
 		return err
 	}
 
-	videoURL := "https://" + cfg.s3CfDistribution + "/" + s3Key
-	metadata.VideoURL = &videoURL
-	cfg.db.UpdateVideo(metadata)
-
-	log.Println("Info: video", videoURL, "uploaded to s3Bucket and metadata stored in db")
+	// See updateThumbnail.
+	ctx = context.WithoutCancel(ctx)
+	previous := metadata.VideoFile
+	metadata.VideoFile = &blob.StoredObject
+	metadata.VideoSHA256 = &blob.SHA256
+	metadata.VideoURL = nil
+	if err := cfg.db.UpdateVideo(ctx, metadata); err != nil {
+		cfg.releaseObject(ctx, &blob.StoredObject)
+		return err
+	}
+	cfg.releaseObject(ctx, previous)
 
+	slog.InfoContext(ctx, "video stored and metadata stored in db", "backend", blob.Backend, "video_key", blob.Key)
 	return nil
 }
 
-type ffprobeOutput struct {
-	Streams []struct {
-		Width  int `json:"width"`
-		Height int `json:"height"`
-	} `json:"streams"`
-}
-
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-
-	var output bytes.Buffer
-	cmd.Stdout = &output
-
-	if err := cmd.Run(); err != nil {
-		log.Println("Error: cmd failed to run:", err)
-		return "", err
+// copyFile copies src from its current offset into a new file at dst. The
+// copy is written beside dst and renamed into place, so a failed or
+// concurrent copy never leaves a partial file at dst.
+func copyFile(dst string, src io.Reader) error {
+	f, err := os.CreateTemp(filepath.Dir(dst), ".tmp-"+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
 	}
-
-	var videoDimensions ffprobeOutput
-	if err := json.Unmarshal(output.Bytes(), &videoDimensions); err != nil {
-		log.Println("Error: could not marhsal data:", err)
-		return "", err
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
 	}
-
-	width := videoDimensions.Streams[0].Width
-	height := videoDimensions.Streams[0].Height
-	ratio := float64(width) / float64(height)
-	log.Println("Aspect ratio found", ratio)
-
-	const tolerance = 0.02 // 2% tolerance
-
-	switch {
-	case math.Abs(ratio-16.0/9.0) < tolerance: // ~1.778
-		return "landscape", nil
-	case math.Abs(ratio-9.0/16.0) < tolerance: // ~0.5625
-		return "portrait", nil
-	default:
-		return "other", nil
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
 	}
+	if err := os.Rename(f.Name(), dst); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
 }
 
-func copyDataToFile(multipartFile multipart.File) (*os.File, error) {
-	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+// copyDataToFile streams the upload into a temp file, verifying it against
+// the client's checksums on the way. The body size limit is enforced by the
+// http.MaxBytesReader around the request body.
+func copyDataToFile(ctx context.Context, tempDir string, upload io.Reader, checksums uploadChecksums) (*os.File, error) {
+	tempFile, err := os.CreateTemp(tempDir, "tubely-upload-*.mp4")
 	if err != nil {
-		log.Println("Error:", err)
 		return nil, err
 	}
 
-	if _, err := io.Copy(tempFile, multipartFile); err != nil {
-		log.Println("Error: could not copy multipart to temp:", err)
+	verifier := checksums.verifier()
+	n, err := io.Copy(io.MultiWriter(tempFile, verifier), upload)
+	if err != nil {
+		removeTempFile(tempFile)
+		return nil, fmt.Errorf("could not copy upload to temp file: %w", err)
+	}
+	if err := verifier.verify(); err != nil {
+		removeTempFile(tempFile)
 		return nil, err
 	}
 
 	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
-		log.Println("Error: could not seek to temp file start:", err)
-		return nil, err
+		removeTempFile(tempFile)
+		return nil, fmt.Errorf("could not seek to temp file start: %w", err)
 	}
-	log.Println("Info: video data copied to local temp file")
+	slog.DebugContext(ctx, "video data copied to local temp file", "bytes", n)
+	metrics.UploadBytes.WithLabelValues("video").Add(float64(n))
 
 	return tempFile, nil
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
-	outputFilePath := filePath + ".processing"
-
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
-	log.Println("Info: cmd created:", cmd)
-
-	if err := cmd.Run(); err != nil {
-		log.Println("Error: cmd failed to run:", err)
-		return "", err
-	}
-
-	log.Println("Info: video processed for fast start")
-	return outputFilePath, nil
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
 }
@@ -1,14 +1,20 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/tracing"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/validation"
 	"github.com/google/uuid"
 )
 
@@ -23,56 +29,72 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		RefreshToken string `json:"refresh_token"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+	if !decodeJSON(w, r, &params) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(params.Email)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if errors.Is(err, database.ErrNotFound) {
+		cfg.recordLoginAttempt(r.Context(), r, nil, params.Email, database.LoginUnknownEmail)
+		respondWithErrorCode(w, r, http.StatusUnauthorized, codeInvalidCredentials, "Incorrect email or password", nil)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", user.ID.String()))
 
-	match, err := auth.CheckPasswordHash(params.Password, user.Password)
+	failures, err := cfg.db.GetLoginFailures(r.Context(), user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't check login attempts", err)
 		return
 	}
-	if !match {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", nil)
+	if until := cfg.lockedUntil(failures); time.Now().Before(until) {
+		cfg.recordLoginAttempt(r.Context(), r, &user.ID, params.Email, database.LoginLocked)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(time.Until(until))))
+		respondWithErrorCode(w, r, http.StatusTooManyRequests, codeAccountLocked, "Too many failed sign-in attempts, try again later", nil)
+		return
+	}
+
+	match, err := auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil || !match {
+		cfg.recordLoginAttempt(r.Context(), r, &user.ID, params.Email, database.LoginBadPassword)
+		if failures.Count+1 >= cfg.loginMaxFailures {
+			slog.WarnContext(r.Context(), "account locked after failed sign-ins", "failures", failures.Count+1)
+		}
+		respondWithErrorCode(w, r, http.StatusUnauthorized, codeInvalidCredentials, "Incorrect email or password", err)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
 		cfg.jwtSecret,
-		time.Hour*24*30,
+		cfg.accessTokenTTL,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create access JWT", err)
 		return
 	}
 
 	refreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create refresh token", err)
 		return
 	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+	_, err = cfg.db.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
 		UserID:    user.ID,
 		Token:     refreshToken,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
+		ExpiresAt: time.Now().UTC().Add(cfg.refreshTokenTTL),
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't save refresh token", err)
 		return
 	}
 
+	cfg.recordLoginAttempt(r.Context(), r, &user.ID, params.Email, database.LoginSuccess)
 	respondWithJSON(w, http.StatusOK, response{
 		User:         user,
 		Token:        accessToken,
@@ -87,23 +109,28 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find token", err)
 		return
 	}
 
-	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+	rt, err := cfg.db.GetRefreshToken(r.Context(), refreshToken)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get refresh token", err)
+		return
+	}
+	if errors.Is(err, database.ErrNotFound) || rt.RevokedAt != nil || time.Now().After(rt.ExpiresAt) {
+		respondWithErrorCode(w, r, http.StatusUnauthorized, codeInvalidToken, "Refresh token is invalid, expired or revoked", nil)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", rt.UserID.String()))
 
 	accessToken, err := auth.MakeJWT(
-		user.ID,
+		rt.UserID,
 		cfg.jwtSecret,
-		time.Hour,
+		cfg.accessTokenTTL,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create access JWT", err)
 		return
 	}
 
@@ -115,13 +142,13 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find token", err)
 		return
 	}
 
-	err = cfg.db.RevokeRefreshToken(refreshToken)
+	err = cfg.db.RevokeRefreshToken(r.Context(), refreshToken)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't revoke session", err)
 		return
 	}
 
@@ -134,105 +161,247 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		Email    string `json:"email"`
 	}
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+	if !decodeJSON(w, r, &params) {
 		return
 	}
 
-	if params.Password == "" || params.Email == "" {
-		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
+	var errs validation.Errors
+	errs.Check("email", validation.Required(params.Email), validation.Email(params.Email))
+	errs.Check("password", validation.Required(params.Password), validation.Password(params.Password))
+	if err := errs.Err(); err != nil {
+		respondWithValidationError(w, r, err)
 		return
 	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't hash password", err)
 		return
 	}
 
-	user, err := cfg.db.CreateUser(database.CreateUserParams{
+	user, err := cfg.db.CreateUser(r.Context(), database.CreateUserParams{
 		Email:    params.Email,
 		Password: hashedPassword,
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create user", err)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", user.ID.String()))
+
+	// The account works without verification, so a failed send is only
+	// logged; the user can ask for another link.
+	if err := cfg.sendUserToken(r.Context(), user.ID, user.Email, database.TokenPurposeVerifyEmail); err != nil {
+		slog.ErrorContext(r.Context(), "could not send verification email", "error", err)
+	}
 
 	respondWithJSON(w, http.StatusCreated, user)
 }
 
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+)
+
 func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
-		database.CreateVideoParams
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Visibility  string `json:"visibility"`
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
 
-	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
-	err = decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPublic
+	}
+	if err := checkVideoFields(&params.Title, &params.Description, &params.Visibility); err != nil {
+		respondWithValidationError(w, r, err)
 		return
 	}
-	params.UserID = userID
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	video, err := cfg.db.CreateVideo(r.Context(), database.CreateVideoParams{
+		Title:       params.Title,
+		Description: params.Description,
+		Visibility:  params.Visibility,
+		UserID:      userID,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create video", err)
 		return
 	}
 
+	w.Header().Set("ETag", videoETag(video))
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
+// checkVideoFields validates the editable fields of a video, skipping nil
+// ones.
+func checkVideoFields(title, description, visibility *string) error {
+	var errs validation.Errors
+	if title != nil {
+		errs.Check("title",
+			validation.Required(*title),
+			validation.Length(*title, 1, maxTitleLength),
+			validation.NoControlChars(*title, false),
+		)
+	}
+	if description != nil {
+		errs.Check("description",
+			validation.Length(*description, 0, maxDescriptionLength),
+			validation.NoControlChars(*description, true),
+		)
+	}
+	if visibility != nil {
+		errs.Check("visibility", validation.OneOf(*visibility, database.VisibilityPublic, database.VisibilityPrivate))
+	}
+	return errs.Err()
+}
+
+// handlerVideoMetaUpdate changes the fields present in the body and leaves
+// the others alone. With an If-Match header the update is only made if the
+// video hasn't changed since the client fetched it, so concurrent edits
+// aren't silently lost.
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+		Visibility  *string `json:"visibility"`
+	}
+
+	videoID, userID, err := validateRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	if err := checkVideoFields(params.Title, params.Description, params.Visibility); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	video, err := getVideoMetadata(cfg, w, r, videoID, userID)
+	if err != nil {
+		return
+	}
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch != "" && !etagMatches(ifMatch, videoETag(video)) {
+		w.Header().Set("ETag", videoETag(video))
+		respondWithError(w, r, http.StatusPreconditionFailed, "Video has changed since it was fetched", nil)
+		return
+	}
+
+	lastUpdated := video.UpdatedAt
+	if params.Title != nil {
+		video.Title = *params.Title
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	if params.Visibility != nil {
+		video.Visibility = *params.Visibility
+	}
+
+	if ifMatch != "" {
+		err = cfg.db.UpdateVideoIfUnmodified(r.Context(), &video, lastUpdated)
+	} else {
+		err = cfg.db.UpdateVideo(r.Context(), &video)
+	}
+	switch {
+	case errors.Is(err, database.ErrConflict):
+		respondWithError(w, r, http.StatusPreconditionFailed, "Video has changed since it was fetched", err)
+		return
+	case errors.Is(err, database.ErrNotFound):
+		respondWithError(w, r, http.StatusNotFound, "Video not found", err)
+		return
+	case err != nil:
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	cfg.resolveURLs(&video)
+	w.Header().Set("ETag", videoETag(video))
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// videoETag identifies the version of a video. UpdateVideo sets UpdatedAt
+// on every change, so it changes whenever the video does.
+func videoETag(video database.Video) string {
+	return `"` + strconv.FormatInt(video.UpdatedAt.UnixMilli(), 10) + `"`
+}
+
+// etagMatches reports whether an If-Match header value matches etag, using
+// the strong comparison If-Match requires.
+func etagMatches(ifMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithError(w, r, http.StatusBadRequest, "Invalid ID", err)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("video_id", videoID.String()))
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+		respondWithError(w, r, http.StatusForbidden, "You can't delete this video", nil)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.DeleteVideo(r.Context(), videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.releaseObject(r.Context(), video.Thumbnail)
+	cfg.releaseObject(r.Context(), video.VideoFile)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -241,133 +410,203 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithError(w, r, http.StatusBadRequest, "Invalid video ID", err)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("video_id", videoID.String()))
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get video", err)
 		return
 	}
+	if video.Visibility == database.VisibilityPrivate {
+		// Metadata is fetched with an Authorization header; only media
+		// elements need the token query parameter.
+		token, err := auth.GetBearerToken(r.Header)
+		userID := uuid.Nil
+		if err == nil {
+			userID, err = auth.ValidateJWT(token, cfg.jwtSecret)
+		}
+		if err != nil || userID != video.UserID {
+			respondWithError(w, r, http.StatusNotFound, "Video not found", err)
+			return
+		}
+	}
 
+	cfg.resolveURLs(&video)
+	w.Header().Set("ETag", videoETag(video))
 	respondWithJSON(w, http.StatusOK, video)
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
 
-	videos, err := cfg.db.GetVideos(userID)
+	// ?tag=a&tag=b returns the videos tagged with both.
+	tags, err := normalizeTags("tag", r.URL.Query()["tag"])
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		respondWithValidationError(w, r, err)
 		return
 	}
 
+	videos, err := cfg.db.GetVideos(r.Context(), userID, tags...)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+	for i := range videos {
+		cfg.resolveURLs(&videos[i])
+	}
+
 	respondWithJSON(w, http.StatusOK, videos)
 }
 
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailUploadBytes)
+
 	videoID, userID, err := validateRequest(cfg, w, r)
 	if err != nil {
-		log.Println("Error: could not validate request:", err)
 		return
 	}
 
-	log.Println("uploading thumbnail for video", videoID, "by user", userID)
+	slog.InfoContext(r.Context(), "uploading thumbnail")
 
-	mediaType, multipartFile, err := parseUploadReq(w, r, "thumbnail")
+	checksums, err := parseUploadChecksums(r.Header)
 	if err != nil {
-		log.Println("Error: could not parse request:", err)
+		respondWithError(w, r, http.StatusBadRequest, err.Error(), err)
 		return
 	}
 
-	metadata, err := getVideoMetadata(cfg, w, videoID, userID)
+	// Check ownership before reading the body.
+	metadata, err := getVideoMetadata(cfg, w, r, videoID, userID)
 	if err != nil {
-		log.Println("Error:", err)
 		return
 	}
-	log.Println("Info: image metdata retrieved from db and user ID verified")
+	slog.DebugContext(r.Context(), "video metadata retrieved and owner verified")
 
-	if err := cfg.updateThumbnail(multipartFile, mediaType, metadata); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update thumbnail", err)
-		log.Println("Error: could not update thumbnail:", err)
+	mediaType, upload, err := parseUploadReq(w, r, "thumbnail")
+	if err != nil {
 		return
 	}
 
-	log.Println("Info: thumbnail successfully set")
+	if err := cfg.updateThumbnail(r.Context(), upload, mediaType, checksums, &metadata); err != nil {
+		if errors.Is(err, errChecksumMismatch) {
+			respondWithErrorCode(w, r, http.StatusBadRequest, codeChecksumMismatch, "Thumbnail doesn't match the supplied checksum", err)
+			return
+		}
+		respondWithError(w, r, uploadErrorStatus(err, http.StatusInternalServerError), "Couldn't update thumbnail", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "thumbnail successfully set")
+	cfg.resolveURLs(&metadata)
+	w.Header().Set("ETag", videoETag(metadata))
 	respondWithJSON(w, http.StatusOK, metadata)
 }
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, 1*GiB)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoUploadBytes)
 
 	videoID, userID, err := validateRequest(cfg, w, r)
 	if err != nil {
-		log.Println("Error: could not validate request:", err)
 		return
 	}
 
-	log.Println("uploading video", videoID, "by user", userID)
+	slog.InfoContext(r.Context(), "uploading video")
+
+	checksums, err := parseUploadChecksums(r.Header)
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, err.Error(), err)
+		return
+	}
 
-	mediaType, multipartFile, err := parseUploadReq(w, r, "video")
+	// Check ownership before reading the body.
+	metadata, err := getVideoMetadata(cfg, w, r, videoID, userID)
 	if err != nil {
-		log.Println("Error: could not parse request:", err)
 		return
 	}
-	defer multipartFile.Close()
+	slog.DebugContext(r.Context(), "video metadata retrieved and owner verified")
 
-	metadata, err := getVideoMetadata(cfg, w, videoID, userID)
+	_, span := startStage(r.Context(), "upload.parse_multipart")
+	mediaType, upload, err := parseUploadReq(w, r, "video")
+	tracing.End(span, err)
 	if err != nil {
-		log.Println("Error:", err)
 		return
 	}
-	log.Println("Info: video metdata retrieved from db and user ID verified")
 
-	tempFile, err := copyDataToFile(multipartFile)
+	// Report the outcome to anyone following the upload's progress.
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			cfg.progress.publish(videoID, progressEvent{Stage: stageFailed, Error: "upload failed"})
+		}
+	}()
+
+	ctx, span := startStage(r.Context(), "upload.copy_to_temp_file")
+	tempFile, err := copyDataToFile(ctx, cfg.tempDir, upload, checksums)
+	tracing.End(span, err)
+	if errors.Is(err, errChecksumMismatch) {
+		respondWithErrorCode(w, r, http.StatusBadRequest, codeChecksumMismatch, "Video doesn't match the supplied checksum", err)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to process upload", err)
+		respondWithError(w, r, uploadErrorStatus(err, http.StatusInternalServerError), "Failed to process upload", err)
 		return
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	defer removeTempFile(tempFile)
+	cfg.progress.publish(videoID, progressEvent{Stage: stageReceived})
 
-	orientation, err := getVideoAspectRatio(tempFile.Name())
+	cfg.progress.publish(videoID, progressEvent{Stage: stageProbing})
+	ctx, span = startStage(r.Context(), "upload.ffprobe")
+	probe, err := cfg.media.Probe(ctx, tempFile.Name())
+	tracing.End(span, err)
 	if err != nil {
-		log.Println("Error: could not get orientation:", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to process upload", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Failed to process upload", fmt.Errorf("could not probe video: %w", err))
 		return
 	}
 
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	cfg.progress.publish(videoID, progressEvent{Stage: stageRemuxing})
+	ctx, span = startStage(r.Context(), "upload.faststart_remux")
+	processedFilePath, err := cfg.media.FastStart(ctx, tempFile.Name())
+	tracing.End(span, err)
 	if err != nil {
-		log.Println("Error: could not process file to fast start:", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to process upload", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Failed to process upload", fmt.Errorf("could not process video for fast start: %w", err))
 		return
 	}
+	defer os.Remove(processedFilePath)
+	// The remuxed copy replaces the upload, so only one full-size file is
+	// kept on disk from here on.
+	removeTempFile(tempFile)
 
 	processedFile, err := os.Open(processedFilePath)
 	if err != nil {
-		log.Println("Error: could not open processedFilePath :", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to process upload", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Failed to process upload", err)
 		return
 	}
-	defer os.Remove(processedFile.Name())
 	defer processedFile.Close()
 
-	if err := cfg.updateVideo(processedFile, orientation, mediaType, metadata); err != nil {
-		log.Println("Error: could not update video", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to process upload", err)
+	if err := cfg.updateVideo(r.Context(), processedFile, probe.Orientation(), mediaType, &metadata); err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Failed to process upload", fmt.Errorf("could not update video: %w", err))
 		return
 	}
+	succeeded = true
+	cfg.progress.publish(videoID, progressEvent{Stage: stageDone})
 
+	cfg.resolveURLs(&metadata)
+	w.Header().Set("ETag", videoETag(metadata))
 	respondWithJSON(w, http.StatusOK, metadata)
 }
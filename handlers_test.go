@@ -0,0 +1,2550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mail"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/validation"
+	"github.com/google/uuid"
+)
+
+const testJWTSecret = "test-secret"
+
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	err     error
+	// afterPut, if set, runs once an object has been stored.
+	afterPut func()
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	if params.ChecksumSHA256 != nil {
+		sum := sha256.Sum256(data)
+		if *params.ChecksumSHA256 != base64.StdEncoding.EncodeToString(sum[:]) {
+			return nil, errors.New("checksum mismatch")
+		}
+	}
+	f.mu.Lock()
+	f.objects[*params.Key] = data
+	f.mu.Unlock()
+	if f.afterPut != nil {
+		f.afterPut()
+	}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, f.err
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, *params.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// fakeMailer records sent messages.
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (m *fakeMailer) Send(ctx context.Context, msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// lastToken returns the token in the link of the last message sent.
+func (m *fakeMailer) lastToken(t *testing.T) string {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.sent) == 0 {
+		t.Fatal("expected a message to be sent")
+	}
+	body := m.sent[len(m.sent)-1].Body
+	i := strings.Index(body, "_token=")
+	if i < 0 {
+		t.Fatalf("no token in message body %q", body)
+	}
+	return strings.Fields(body[i+len("_token="):])[0]
+}
+
+type testEnv struct {
+	cfg    *apiConfig
+	dbPath string
+	s3     *fakeS3
+	media  *media.Fake
+	mailer *fakeMailer
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	dir := t.TempDir()
+
+	dbPath := filepath.Join(dir, "test.db")
+	db, err := database.NewClient(dbPath)
+	if err != nil {
+		t.Fatalf("could not create database: %v", err)
+	}
+
+	env := &testEnv{
+		dbPath: dbPath,
+		s3:     newFakeS3(),
+		media:  media.NewFake(media.ProbeResult{Width: 1920, Height: 1080}),
+		mailer: &fakeMailer{},
+	}
+	env.cfg = &apiConfig{
+		db:               db,
+		s3Client:         env.s3,
+		media:            env.media,
+		jwtSecret:        testJWTSecret,
+		platform:         "dev",
+		assetsRoot:       filepath.Join(dir, "assets"),
+		s3Bucket:         "test-bucket",
+		s3Region:         "us-east-2",
+		s3CfDistribution: "cdn.example.com",
+		videoBackend:     database.BackendS3,
+		port:             "8091",
+		publicBaseURL:    "http://localhost:8091",
+		urls: urlResolver{
+			assetsBaseURL: "https://cdn.example.com/assets",
+			s3Bucket:      "test-bucket",
+			s3Region:      "us-east-2",
+			s3CDNDomain:   "cdn.example.com",
+		},
+
+		maxVideoUploadBytes:     1 * GiB,
+		maxThumbnailUploadBytes: 10 * MiB,
+		accessTokenTTL:          time.Hour,
+		refreshTokenTTL:         24 * time.Hour,
+		loginMaxFailures:        3,
+		loginLockout:            time.Minute,
+		loginLockoutMax:         time.Hour,
+		emailVerificationTTL:    time.Hour,
+		passwordResetTTL:        time.Hour,
+		cacheMaxAge:             time.Hour,
+		s3UploadTimeout:         time.Minute,
+
+		tempDir:     t.TempDir(),
+		uploads:     &jobTracker{},
+		progress:    newProgressHub(),
+		assetHashes: newHashCache(),
+		rateLimiter: ratelimit.NewMemoryStore(),
+		mailer:      env.mailer,
+	}
+	if err := env.cfg.ensureAssetsDir(); err != nil {
+		t.Fatalf("could not create assets dir: %v", err)
+	}
+	return env
+}
+
+// createVideo creates a user owning a new video draft and returns the
+// video with a valid access token for its owner.
+func (env *testEnv) createVideo(t *testing.T) (database.Video, string) {
+	t.Helper()
+	ctx := context.Background()
+
+	user, err := env.cfg.db.CreateUser(ctx, database.CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "hash",
+	})
+	if err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+
+	video, err := env.cfg.db.CreateVideo(ctx, database.CreateVideoParams{
+		Title:       "Boots",
+		Description: "A bear",
+		UserID:      user.ID,
+	})
+	if err != nil {
+		t.Fatalf("could not create video: %v", err)
+	}
+
+	return video, env.tokenFor(t, user.ID)
+}
+
+func (env *testEnv) tokenFor(t *testing.T, userID uuid.UUID) string {
+	t.Helper()
+	token, err := auth.MakeJWT(userID, testJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("could not make JWT: %v", err)
+	}
+	return token
+}
+
+// openDB opens a second connection to the test database, for checking
+// state the client doesn't expose.
+func (env *testEnv) openDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", env.dbPath)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// blobRefs returns the reference count of the blob row for obj, or 0 if
+// there is none.
+func (env *testEnv) blobRefs(t *testing.T, obj database.StoredObject) int {
+	t.Helper()
+	var refs int
+	err := env.openDB(t).QueryRow(`SELECT ref_count FROM blobs WHERE backend = ? AND bucket = ? AND key = ?`, obj.Backend, obj.Bucket, obj.Key).Scan(&refs)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("could not read blob: %v", err)
+	}
+	return refs
+}
+
+func newUploadRequest(t *testing.T, path, videoID, token, field, contentType string, data []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="`+field+`"; filename="upload"`)
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatalf("could not create part: %v", err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path+videoID, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.SetPathValue("videoID", videoID)
+	return req
+}
+
+func TestHandlerUploadVideo(t *testing.T) {
+	videoData := []byte("not really an mp4")
+
+	t.Run("uploads processed video to s3", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", videoData)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		keys := env.s3.keys()
+		if len(keys) != 1 {
+			t.Fatalf("expected one object in s3, got %d", len(keys))
+		}
+		if !strings.HasPrefix(keys[0], "landscape/") {
+			t.Errorf("expected key with landscape prefix, got %q", keys[0])
+		}
+		if got := env.s3.objects[keys[0]]; !bytes.Equal(got, videoData) {
+			t.Errorf("stored object does not match upload")
+		}
+
+		calls := env.media.Calls()
+		if len(calls) != 2 || calls[0] != "Probe" || calls[1] != "FastStart" {
+			t.Errorf("unexpected media calls: %v", calls)
+		}
+
+		stored, err := env.cfg.db.GetVideo(context.Background(), video.ID)
+		if err != nil {
+			t.Fatalf("could not get video: %v", err)
+		}
+		if stored.VideoFile == nil || stored.VideoFile.Key != keys[0] || stored.VideoFile.Backend != database.BackendS3 {
+			t.Errorf("expected stored s3 object %q, got %+v", keys[0], stored.VideoFile)
+		}
+
+		var resp database.Video
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+		want := "https://cdn.example.com/" + keys[0]
+		if resp.VideoURL == nil || *resp.VideoURL != want {
+			t.Errorf("expected video URL %q, got %v", want, resp.VideoURL)
+		}
+	})
+
+	t.Run("portrait video", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.media.ProbeResult = media.ProbeResult{Width: 1080, Height: 1920}
+		video, token := env.createVideo(t)
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", videoData)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if keys := env.s3.keys(); len(keys) != 1 || !strings.HasPrefix(keys[0], "portrait/") {
+			t.Errorf("expected one key with portrait prefix, got %v", keys)
+		}
+	})
+
+	tests := []struct {
+		name       string
+		setup      func(env *testEnv)
+		otherUser  bool
+		noToken    bool
+		mediaType  string
+		wantStatus int
+	}{
+		{
+			name:       "missing token",
+			noToken:    true,
+			mediaType:  "video/mp4",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "not the owner",
+			otherUser:  true,
+			mediaType:  "video/mp4",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "invalid media type",
+			mediaType:  "image/png",
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "probe fails",
+			setup:      func(env *testEnv) { env.media.ProbeErr = errors.New("probe failed") },
+			mediaType:  "video/mp4",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "fast start fails",
+			setup:      func(env *testEnv) { env.media.ProcessErr = errors.New("ffmpeg failed") },
+			mediaType:  "video/mp4",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "s3 upload fails",
+			setup:      func(env *testEnv) { env.s3.err = errors.New("s3 unavailable") },
+			mediaType:  "video/mp4",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			if tc.setup != nil {
+				tc.setup(env)
+			}
+			video, token := env.createVideo(t)
+			switch {
+			case tc.noToken:
+				token = ""
+			case tc.otherUser:
+				token = env.tokenFor(t, uuid.New())
+			}
+
+			req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", tc.mediaType, videoData)
+			rr := httptest.NewRecorder()
+			env.cfg.handlerUploadVideo(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, rr.Code, rr.Body.String())
+			}
+
+			stored, err := env.cfg.db.GetVideo(context.Background(), video.ID)
+			if err != nil {
+				t.Fatalf("could not get video: %v", err)
+			}
+			if stored.VideoFile != nil {
+				t.Errorf("expected video file to stay unset, got %+v", stored.VideoFile)
+			}
+		})
+	}
+
+	t.Run("invalid video ID", func(t *testing.T) {
+		env := newTestEnv(t)
+		_, token := env.createVideo(t)
+
+		req := newUploadRequest(t, "/api/video_upload/", "not-a-uuid", token, "video", "video/mp4", videoData)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", rr.Code)
+		}
+	})
+}
+
+func TestHandlerUploadThumbnail(t *testing.T) {
+	imageData := []byte("\x89PNG fake image")
+
+	t.Run("stores thumbnail in assets", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+
+		req := newUploadRequest(t, "/api/thumbnail_upload/", video.ID.String(), token, "thumbnail", "image/png", imageData)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadThumbnail(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		stored, err := env.cfg.db.GetVideo(context.Background(), video.ID)
+		if err != nil {
+			t.Fatalf("could not get video: %v", err)
+		}
+		if stored.Thumbnail == nil || stored.Thumbnail.Backend != database.BackendLocal {
+			t.Fatalf("expected local thumbnail to be set, got %+v", stored.Thumbnail)
+		}
+		fileName := stored.Thumbnail.Key
+		if !strings.HasSuffix(fileName, ".png") {
+			t.Errorf("expected .png asset, got %q", fileName)
+		}
+		if stored.ThumbnailURL != nil {
+			t.Errorf("expected no absolute URL in the database, got %q", *stored.ThumbnailURL)
+		}
+
+		var resp database.Video
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+		wantURL := "https://cdn.example.com/assets/" + fileName
+		if resp.ThumbnailURL == nil || *resp.ThumbnailURL != wantURL {
+			t.Errorf("expected thumbnail URL %q in response, got %v", wantURL, resp.ThumbnailURL)
+		}
+
+		got, err := os.ReadFile(filepath.Join(env.cfg.assetsRoot, fileName))
+		if err != nil {
+			t.Fatalf("could not read stored thumbnail: %v", err)
+		}
+		if !bytes.Equal(got, imageData) {
+			t.Errorf("stored thumbnail does not match upload")
+		}
+		if calls := env.media.Calls(); len(calls) != 0 {
+			t.Errorf("expected no media processing, got %v", calls)
+		}
+	})
+
+	tests := []struct {
+		name       string
+		otherUser  bool
+		noToken    bool
+		mediaType  string
+		wantStatus int
+	}{
+		{name: "missing token", noToken: true, mediaType: "image/png", wantStatus: http.StatusUnauthorized},
+		{name: "not the owner", otherUser: true, mediaType: "image/jpeg", wantStatus: http.StatusForbidden},
+		{name: "invalid media type", mediaType: "image/gif", wantStatus: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			video, token := env.createVideo(t)
+			switch {
+			case tc.noToken:
+				token = ""
+			case tc.otherUser:
+				token = env.tokenFor(t, uuid.New())
+			}
+
+			req := newUploadRequest(t, "/api/thumbnail_upload/", video.ID.String(), token, "thumbnail", tc.mediaType, imageData)
+			rr := httptest.NewRecorder()
+			env.cfg.handlerUploadThumbnail(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, rr.Code, rr.Body.String())
+			}
+
+			entries, err := os.ReadDir(env.cfg.assetsRoot)
+			if err != nil {
+				t.Fatalf("could not read assets dir: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("expected no assets to be written, found %d", len(entries))
+			}
+		})
+	}
+}
+
+func TestHandlerAssetGet(t *testing.T) {
+	data := []byte("0123456789 fake thumbnail")
+
+	// storeAsset writes data as the video's local thumbnail.
+	storeAsset := func(t *testing.T, env *testEnv, video database.Video, key string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(env.cfg.assetsRoot, key), data, 0o644); err != nil {
+			t.Fatalf("could not write asset: %v", err)
+		}
+		video.Thumbnail = &database.StoredObject{Backend: database.BackendLocal, Key: key}
+		if err := env.cfg.db.UpdateVideo(context.Background(), &video); err != nil {
+			t.Fatalf("could not update video: %v", err)
+		}
+	}
+
+	get := func(env *testEnv, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/assets/"+target, nil)
+		req.SetPathValue("key", strings.TrimPrefix(req.URL.Path, "/assets/"))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		env.cfg.handlerAssetGet(rr, req)
+		return rr
+	}
+
+	t.Run("serves ranges and revalidates by etag", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, _ := env.createVideo(t)
+		storeAsset(t, env, video, "thumb.png")
+
+		rr := get(env, "thumb.png", http.Header{"Range": {"bytes=2-5"}})
+		if rr.Code != http.StatusPartialContent {
+			t.Fatalf("expected status 206, got %d", rr.Code)
+		}
+		if got := rr.Body.String(); got != "2345" {
+			t.Errorf("expected range body %q, got %q", "2345", got)
+		}
+		etag := rr.Header().Get("ETag")
+		if etag == "" {
+			t.Fatal("expected an ETag")
+		}
+		if got := rr.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+			t.Errorf("unexpected Cache-Control %q", got)
+		}
+
+		rr = get(env, "thumb.png", http.Header{"If-None-Match": {etag}})
+		if rr.Code != http.StatusNotModified {
+			t.Errorf("expected status 304, got %d", rr.Code)
+		}
+	})
+
+	t.Run("content addressed files are immutable", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, _ := env.createVideo(t)
+		sum := sha256.Sum256(data)
+		key := hex.EncodeToString(sum[:]) + ".png"
+		storeAsset(t, env, video, key)
+
+		rr := get(env, key, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("Cache-Control"); got != immutableCacheControl {
+			t.Errorf("unexpected Cache-Control %q", got)
+		}
+	})
+
+	t.Run("private assets are only served to the owner", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+		video.Visibility = database.VisibilityPrivate
+		storeAsset(t, env, video, "private.png")
+
+		if rr := get(env, "private.png", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 without a token, got %d", rr.Code)
+		}
+		other := http.Header{"Authorization": {"Bearer " + env.tokenFor(t, uuid.New())}}
+		if rr := get(env, "private.png", other); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for another user, got %d", rr.Code)
+		}
+		if rr := get(env, "private.png?token="+token, nil); rr.Code != http.StatusOK {
+			t.Errorf("expected status 200 with a query token, got %d", rr.Code)
+		}
+	})
+
+	t.Run("shared files are served if any video using them is visible", func(t *testing.T) {
+		env := newTestEnv(t)
+		public, _ := env.createVideo(t)
+		private, privateToken := env.createVideo(t)
+		private.Visibility = database.VisibilityPrivate
+		storeAsset(t, env, private, "shared.png")
+		storeAsset(t, env, public, "shared.png")
+
+		rr := get(env, "shared.png", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200 for a file a public video uses, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+			t.Errorf("unexpected Cache-Control %q", got)
+		}
+
+		public.Visibility = database.VisibilityPrivate
+		storeAsset(t, env, public, "shared.png")
+		if rr := get(env, "shared.png", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 once no public video uses it, got %d", rr.Code)
+		}
+		if rr := get(env, "shared.png?token="+privateToken, nil); rr.Code != http.StatusOK {
+			t.Errorf("expected status 200 for the owner of one of the videos, got %d", rr.Code)
+		}
+	})
+
+	t.Run("unknown assets are not found", func(t *testing.T) {
+		env := newTestEnv(t)
+		if rr := get(env, "missing.png", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+	})
+}
+
+func TestUploadDeduplication(t *testing.T) {
+	videoData := []byte("the same video twice")
+
+	env := newTestEnv(t)
+	first, firstToken := env.createVideo(t)
+	second, secondToken := env.createVideo(t)
+
+	for _, v := range []struct {
+		video database.Video
+		token string
+	}{{first, firstToken}, {second, secondToken}} {
+		req := newUploadRequest(t, "/api/video_upload/", v.video.ID.String(), v.token, "video", "video/mp4", videoData)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	keys := env.s3.keys()
+	if len(keys) != 1 {
+		t.Fatalf("expected duplicate uploads to share one object, got %v", keys)
+	}
+	sum := sha256.Sum256(videoData)
+	if want := "landscape/" + hex.EncodeToString(sum[:]) + ".mp4"; keys[0] != want {
+		t.Errorf("expected content-addressed key %q, got %q", want, keys[0])
+	}
+	obj := database.StoredObject{Backend: database.BackendS3, Bucket: env.cfg.s3Bucket, Key: keys[0]}
+	if refs := env.blobRefs(t, obj); refs != 2 {
+		t.Errorf("expected two references, got %d", refs)
+	}
+
+	deleteVideo := func(video database.Video, token string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodDelete, "/api/videos/"+video.ID.String(), nil)
+		req.SetPathValue("videoID", video.ID.String())
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerVideoMetaDelete(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	deleteVideo(first, firstToken)
+	if len(env.s3.keys()) != 1 {
+		t.Fatal("object deleted while still referenced")
+	}
+
+	deleteVideo(second, secondToken)
+	if keys := env.s3.keys(); len(keys) != 0 {
+		t.Errorf("expected unreferenced object to be deleted, got %v", keys)
+	}
+	if refs := env.blobRefs(t, obj); refs != 0 {
+		t.Errorf("expected blob row to be removed, got %d references", refs)
+	}
+}
+
+func TestStoreBlob(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	params := database.CreateBlobParams{
+		StoredObject: database.StoredObject{Backend: database.BackendS3, Bucket: "test-bucket", Key: "blob.mp4"},
+		SHA256:       "abc",
+		Size:         3,
+	}
+	stores := 0
+	store := func() error {
+		stores++
+		return nil
+	}
+
+	if err := env.cfg.storeBlob(ctx, params, func() error { return errors.New("upload failed") }); err == nil {
+		t.Fatal("expected the store error")
+	}
+	if refs := env.blobRefs(t, params.StoredObject); refs != 0 {
+		t.Errorf("expected a failed store to drop its reference, got %d references", refs)
+	}
+
+	for range 2 {
+		if err := env.cfg.storeBlob(ctx, params, store); err != nil {
+			t.Fatalf("could not store blob: %v", err)
+		}
+	}
+	if stores != 1 {
+		t.Errorf("expected the file to be stored once, got %d", stores)
+	}
+
+	// Releasing every other reference before storing again must not leave
+	// the new reference pointing at a deleted file.
+	env.cfg.releaseObject(ctx, &params.StoredObject)
+	env.cfg.releaseObject(ctx, &params.StoredObject)
+	if err := env.cfg.storeBlob(ctx, params, store); err != nil {
+		t.Fatalf("could not store blob: %v", err)
+	}
+	if stores != 2 {
+		t.Errorf("expected the file to be stored again once unreferenced, got %d stores", stores)
+	}
+	if refs := env.blobRefs(t, params.StoredObject); refs != 1 {
+		t.Errorf("expected one reference, got %d", refs)
+	}
+}
+
+func TestStoreBlobConcurrentFailure(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	params := database.CreateBlobParams{
+		StoredObject: database.StoredObject{Backend: database.BackendS3, Bucket: "test-bucket", Key: "blob.mp4"},
+		SHA256:       "abc",
+		Size:         3,
+	}
+
+	// The first upload is still storing the file when the second arrives,
+	// and then fails.
+	storing, fail := make(chan struct{}), make(chan struct{})
+	firstErr := make(chan error)
+	go func() {
+		firstErr <- env.cfg.storeBlob(ctx, params, func() error {
+			close(storing)
+			<-fail
+			return errors.New("upload failed")
+		})
+	}()
+	<-storing
+
+	stores := 0
+	store := func() error {
+		stores++
+		return nil
+	}
+	if err := env.cfg.storeBlob(ctx, params, store); err != nil {
+		t.Fatalf("could not store blob: %v", err)
+	}
+	close(fail)
+	if err := <-firstErr; err == nil {
+		t.Fatal("expected the first store to fail")
+	}
+
+	if stores != 1 {
+		t.Errorf("expected the second upload to store the file itself, got %d stores", stores)
+	}
+	if refs := env.blobRefs(t, params.StoredObject); refs != 1 {
+		t.Errorf("expected the second upload's reference to remain, got %d", refs)
+	}
+	if err := env.cfg.storeBlob(ctx, params, store); err != nil {
+		t.Fatalf("could not store blob: %v", err)
+	}
+	if stores != 1 {
+		t.Errorf("expected later uploads to reuse the stored file, got %d stores", stores)
+	}
+}
+
+func TestUploadRecordedAfterDisconnect(t *testing.T) {
+	env := newTestEnv(t)
+	video, _ := env.createVideo(t)
+
+	tempFile, err := os.CreateTemp(t.TempDir(), "upload-*.mp4")
+	if err != nil {
+		t.Fatalf("could not create temp file: %v", err)
+	}
+	defer tempFile.Close()
+	if _, err := tempFile.WriteString("stored just before the client left"); err != nil {
+		t.Fatalf("could not write temp file: %v", err)
+	}
+
+	// The client disconnects as soon as the object is stored.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env.s3.afterPut = cancel
+
+	if err := env.cfg.updateVideo(ctx, tempFile, "landscape", "video/mp4", &video); err != nil {
+		t.Fatalf("expected the stored upload to be recorded, got %v", err)
+	}
+	stored, err := env.cfg.db.GetVideo(context.Background(), video.ID)
+	if err != nil {
+		t.Fatalf("could not get video: %v", err)
+	}
+	if stored.VideoFile == nil || len(env.s3.keys()) != 1 || stored.VideoFile.Key != env.s3.keys()[0] {
+		t.Errorf("expected the video to reference the stored object %v, got %+v", env.s3.keys(), stored.VideoFile)
+	}
+}
+
+func TestUploadChecksums(t *testing.T) {
+	videoData := []byte("video with a checksum")
+	sha := sha256.Sum256(videoData)
+	md := md5.Sum(videoData)
+	wrong := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{name: "matching sha256", header: headerUploadSHA256, value: base64.StdEncoding.EncodeToString(sha[:]), wantStatus: http.StatusOK},
+		{name: "matching md5", header: headerUploadMD5, value: base64.StdEncoding.EncodeToString(md[:]), wantStatus: http.StatusOK},
+		{name: "mismatched sha256", header: headerUploadSHA256, value: base64.StdEncoding.EncodeToString(wrong[:]), wantStatus: http.StatusBadRequest},
+		{name: "malformed digest", header: headerUploadMD5, value: "not base64!", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			env := newTestEnv(t)
+			video, token := env.createVideo(t)
+
+			req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", videoData)
+			req.Header.Set(tc.header, tc.value)
+			rr := httptest.NewRecorder()
+			env.cfg.handlerUploadVideo(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, rr.Code, rr.Body.String())
+			}
+			if tc.wantStatus != http.StatusOK {
+				if keys := env.s3.keys(); len(keys) != 0 {
+					t.Errorf("expected nothing stored, got %v", keys)
+				}
+				return
+			}
+
+			stored, err := env.cfg.db.GetVideo(context.Background(), video.ID)
+			if err != nil {
+				t.Fatalf("could not get video: %v", err)
+			}
+			if want := hex.EncodeToString(sha[:]); stored.VideoSHA256 == nil || *stored.VideoSHA256 != want {
+				t.Errorf("expected stored checksum %q, got %v", want, stored.VideoSHA256)
+			}
+		})
+	}
+}
+
+func TestHandlerUploadVideoStreaming(t *testing.T) {
+	t.Run("rejects uploads over the size limit", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.cfg.maxVideoUploadBytes = 1024
+		video, token := env.createVideo(t)
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", bytes.Repeat([]byte("x"), 4096))
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expected status 413, got %d: %s", rr.Code, rr.Body.String())
+		}
+		entries, err := os.ReadDir(env.cfg.tempDir)
+		if err != nil {
+			t.Fatalf("could not read temp dir: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("expected partial upload to be removed, found %d files", len(entries))
+		}
+	})
+
+	t.Run("rejects forms without a video part", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "thumbnail", "video/mp4", []byte("data"))
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("leaves no temp files behind", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", []byte("a small video"))
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		entries, err := os.ReadDir(env.cfg.tempDir)
+		if err != nil {
+			t.Fatalf("could not read temp dir: %v", err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("expected temp dir to be empty, found %d files", len(entries))
+		}
+	})
+}
+
+func TestVideoProgress(t *testing.T) {
+	t.Run("upload publishes each stage", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+		events, cancel := env.cfg.progress.subscribe(video.ID)
+		defer cancel()
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", []byte("some video"))
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		var stages []string
+		for ev := range events {
+			if n := len(stages); n == 0 || stages[n-1] != ev.Stage {
+				stages = append(stages, ev.Stage)
+			}
+		}
+		want := []string{stageReceived, stageProbing, stageRemuxing, stageUploading, stageDone}
+		if strings.Join(stages, ",") != strings.Join(want, ",") {
+			t.Errorf("expected stages %v, got %v", want, stages)
+		}
+	})
+
+	t.Run("failed upload is reported", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.media.ProbeErr = errors.New("probe failed")
+		video, token := env.createVideo(t)
+		events, cancel := env.cfg.progress.subscribe(video.ID)
+		defer cancel()
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", []byte("some video"))
+		env.cfg.handlerUploadVideo(httptest.NewRecorder(), req)
+
+		var last progressEvent
+		for ev := range events {
+			last = ev
+		}
+		if last.Stage != stageFailed {
+			t.Errorf("expected final stage %q, got %q", stageFailed, last.Stage)
+		}
+	})
+
+	t.Run("streams events to the owner", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+		env.cfg.progress.publish(video.ID, progressEvent{Stage: stageProbing})
+
+		req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/progress?token="+token, nil)
+		req.SetPathValue("videoID", video.ID.String())
+		rr := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			env.cfg.handlerVideoProgress(rr, req)
+			close(done)
+		}()
+
+		// wait for the handler to subscribe before finishing the upload
+		for {
+			env.cfg.progress.mu.Lock()
+			subscribed := len(env.cfg.progress.subs[video.ID]) > 0
+			env.cfg.progress.mu.Unlock()
+			if subscribed {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		env.cfg.progress.publish(video.ID, progressEvent{Stage: stageDone})
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream did not end after the final event")
+		}
+		if got := rr.Header().Get("Content-Type"); got != "text/event-stream" {
+			t.Errorf("unexpected Content-Type %q", got)
+		}
+		want := "event: progress\ndata: {\"stage\":\"probing\"}\n\n" +
+			"event: progress\ndata: {\"stage\":\"done\"}\n\n"
+		if got := rr.Body.String(); got != want {
+			t.Errorf("unexpected stream:\n%s", got)
+		}
+	})
+
+	t.Run("other users can't follow progress", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, _ := env.createVideo(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/progress", nil)
+		req.SetPathValue("videoID", video.ID.String())
+		req.Header.Set("Authorization", "Bearer "+env.tokenFor(t, uuid.New()))
+		rr := httptest.NewRecorder()
+		env.cfg.handlerVideoProgress(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	send := func(h http.HandlerFunc, remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		return rr
+	}
+
+	t.Run("limits by ip", func(t *testing.T) {
+		env := newTestEnv(t)
+		h := env.cfg.rateLimit(rateLimitPolicy{name: "test", byIP: ratelimit.PerMinute(1, 2)}, ok)
+
+		for i := 0; i < 2; i++ {
+			if rr := send(h, "192.0.2.1:1234", ""); rr.Code != http.StatusOK {
+				t.Fatalf("request %d: expected status 200, got %d", i, rr.Code)
+			}
+		}
+		rr := send(h, "192.0.2.1:5678", "")
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status 429, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("Retry-After"); got != "60" {
+			t.Errorf("expected Retry-After 60, got %q", got)
+		}
+		if rr := send(h, "192.0.2.2:1234", ""); rr.Code != http.StatusOK {
+			t.Errorf("expected other clients to be unaffected, got %d", rr.Code)
+		}
+	})
+
+	t.Run("limits by user across ips", func(t *testing.T) {
+		env := newTestEnv(t)
+		h := env.cfg.rateLimit(rateLimitPolicy{name: "test", byUser: ratelimit.PerMinute(1, 1)}, ok)
+		token := env.tokenFor(t, uuid.New())
+
+		if rr := send(h, "192.0.2.1:1234", token); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		if rr := send(h, "192.0.2.2:1234", token); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status 429, got %d", rr.Code)
+		}
+		if rr := send(h, "192.0.2.2:1234", env.tokenFor(t, uuid.New())); rr.Code != http.StatusOK {
+			t.Errorf("expected other users to be unaffected, got %d", rr.Code)
+		}
+	})
+
+	t.Run("limits forwarded clients behind a trusted proxy", func(t *testing.T) {
+		env := newTestEnv(t)
+		env.cfg.trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+		h := env.cfg.rateLimit(rateLimitPolicy{name: "test", byIP: ratelimit.PerMinute(1, 1)}, ok)
+		sendVia := func(client string) int {
+			req := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", client)
+			rr := httptest.NewRecorder()
+			h(rr, req)
+			return rr.Code
+		}
+
+		if code := sendVia("192.0.2.1"); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+		if code := sendVia("192.0.2.1"); code != http.StatusTooManyRequests {
+			t.Errorf("expected status 429, got %d", code)
+		}
+		if code := sendVia("192.0.2.2"); code != http.StatusOK {
+			t.Errorf("expected other clients behind the proxy to be unaffected, got %d", code)
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::1/128"),
+	}
+	tests := []struct {
+		name       string
+		trusted    []netip.Prefix
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "no proxies",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "forwarded header ignored without trusted proxies",
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"192.0.2.1"},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "trusted proxy",
+			trusted:    proxies,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"192.0.2.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "untrusted peer",
+			trusted:    proxies,
+			remoteAddr: "192.0.2.9:1234",
+			forwarded:  []string{"192.0.2.1"},
+			want:       "192.0.2.9",
+		},
+		{
+			name:       "spoofed entries before the client",
+			trusted:    proxies,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"203.0.113.7, 192.0.2.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "multiple trusted hops",
+			trusted:    proxies,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"192.0.2.1, 10.0.0.2", "10.0.0.3"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "IPv6 proxy",
+			trusted:    proxies,
+			remoteAddr: "[2001:db8::1]:1234",
+			forwarded:  []string{"2001:db8::2"},
+			want:       "2001:db8::2",
+		},
+		{
+			name:       "IPv4-mapped proxy",
+			trusted:    proxies,
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			forwarded:  []string{"192.0.2.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "malformed entry",
+			trusted:    proxies,
+			remoteAddr: "10.0.0.1:1234",
+			forwarded:  []string{"192.0.2.1, unknown, 10.0.0.2"},
+			want:       "10.0.0.2",
+		},
+		{
+			name:       "no forwarded header",
+			trusted:    proxies,
+			remoteAddr: "10.0.0.1:1234",
+			want:       "10.0.0.1",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &apiConfig{trustedProxies: tc.trusted}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.forwarded {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := cfg.clientIP(req); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	hash, err := auth.HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+	user, err := env.cfg.db.CreateUser(ctx, database.CreateUserParams{Email: "boots@example.com", Password: hash})
+	if err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+
+	login := func(password string) *httptest.ResponseRecorder {
+		body := `{"email":"boots@example.com","password":"` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body))
+		req.Header.Set("User-Agent", "test-agent")
+		rr := httptest.NewRecorder()
+		env.cfg.handlerLogin(rr, req)
+		return rr
+	}
+
+	if rr := login("correct horse"); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for i := 0; i < env.cfg.loginMaxFailures; i++ {
+		if rr := login("wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected status 401, got %d", i, rr.Code)
+		}
+	}
+
+	rr := login("correct horse")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected locked account to get status 429, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("expected Retry-After 60, got %q", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/users/me/logins?limit=3", nil)
+	req.Header.Set("Authorization", "Bearer "+env.tokenFor(t, user.ID))
+	rr = httptest.NewRecorder()
+	env.cfg.handlerLoginAttemptsGet(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var attempts []database.LoginAttempt
+	if err := json.Unmarshal(rr.Body.Bytes(), &attempts); err != nil {
+		t.Fatalf("could not decode attempts: %v", err)
+	}
+	var results []string
+	for _, a := range attempts {
+		results = append(results, a.Result)
+		if a.UserAgent != "test-agent" || a.IP == "" {
+			t.Errorf("expected client details to be recorded, got %+v", a)
+		}
+	}
+	want := []string{database.LoginLocked, database.LoginBadPassword, database.LoginBadPassword}
+	if strings.Join(results, ",") != strings.Join(want, ",") {
+		t.Errorf("expected newest attempts %v, got %v", want, results)
+	}
+}
+
+func TestLockedUntil(t *testing.T) {
+	cfg := &apiConfig{loginMaxFailures: 3, loginLockout: time.Minute, loginLockoutMax: 10 * time.Minute}
+	last := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Minute},
+		{failures: 4, want: 2 * time.Minute},
+		{failures: 6, want: 8 * time.Minute},
+		{failures: 20, want: 10 * time.Minute},
+	}
+	for _, tc := range tests {
+		got := cfg.lockedUntil(database.LoginFailures{Count: tc.failures, Last: last})
+		if tc.want == 0 {
+			if !got.IsZero() {
+				t.Errorf("%d failures: expected no lockout, got %v", tc.failures, got)
+			}
+			continue
+		}
+		if d := got.Sub(last); d != tc.want {
+			t.Errorf("%d failures: expected lockout of %v, got %v", tc.failures, tc.want, d)
+		}
+	}
+}
+
+// postJSON calls h with body as a JSON request.
+func postJSON(h http.HandlerFunc, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	h(rr, req)
+	return rr
+}
+
+func TestEmailVerification(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	rr := postJSON(env.cfg.handlerUsersCreate, "/api/users", `{"email":"not an email","password":"hunter2hunter2"}`, "")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected invalid email to get status 422, got %d", rr.Code)
+	}
+
+	rr = postJSON(env.cfg.handlerUsersCreate, "/api/users", `{"email":"boots@example.com","password":"hunter2hunter2"}`, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var user database.User
+	if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+		t.Fatalf("could not decode user: %v", err)
+	}
+	if user.EmailVerifiedAt != nil {
+		t.Error("expected new user to be unverified")
+	}
+	if to := env.mailer.sent[0].To; to != "boots@example.com" {
+		t.Errorf("expected verification email to boots@example.com, got %q", to)
+	}
+	token := env.mailer.lastToken(t)
+
+	body := `{"token":"` + token + `"}`
+	if rr := postJSON(env.cfg.handlerEmailVerificationConfirm, "/api/email_verification/confirm", body, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	stored, err := env.cfg.db.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if stored.EmailVerifiedAt == nil {
+		t.Error("expected email to be verified")
+	}
+
+	if rr := postJSON(env.cfg.handlerEmailVerificationConfirm, "/api/email_verification/confirm", body, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected reused token to get status 400, got %d", rr.Code)
+	}
+	if rr := postJSON(env.cfg.handlerEmailVerificationRequest, "/api/email_verification", "", env.tokenFor(t, user.ID)); rr.Code != http.StatusConflict {
+		t.Errorf("expected verified user to get status 409, got %d", rr.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+
+	hash, err := auth.HashPassword("old password")
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+	user, err := env.cfg.db.CreateUser(ctx, database.CreateUserParams{Email: "boots@example.com", Password: hash})
+	if err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+	refresh, err := env.cfg.db.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{
+		Token:     "refresh-token",
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("could not create refresh token: %v", err)
+	}
+
+	if rr := postJSON(env.cfg.handlerPasswordResetRequest, "/api/password_reset", `{"email":"nobody@example.com"}`, ""); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202 for unknown email, got %d", rr.Code)
+	}
+	if len(env.mailer.sent) != 0 {
+		t.Fatal("expected no email for an unknown address")
+	}
+
+	if rr := postJSON(env.cfg.handlerPasswordResetRequest, "/api/password_reset", `{"email":"boots@example.com"}`, ""); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", rr.Code)
+	}
+	token := env.mailer.lastToken(t)
+
+	if rr := postJSON(env.cfg.handlerPasswordResetConfirm, "/api/password_reset/confirm", `{"token":"wrong","password":"new password"}`, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected invalid token to get status 400, got %d", rr.Code)
+	}
+
+	body := `{"token":"` + token + `","password":"new password"}`
+	if rr := postJSON(env.cfg.handlerPasswordResetConfirm, "/api/password_reset/confirm", body, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := postJSON(env.cfg.handlerPasswordResetConfirm, "/api/password_reset/confirm", body, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected reused token to get status 400, got %d", rr.Code)
+	}
+
+	stored, err := env.cfg.db.GetUser(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("could not get user: %v", err)
+	}
+	if match, _ := auth.CheckPasswordHash("new password", stored.Password); !match {
+		t.Error("expected password to be changed")
+	}
+	rt, err := env.cfg.db.GetRefreshToken(ctx, refresh.Token)
+	if err != nil {
+		t.Fatalf("could not get refresh token: %v", err)
+	}
+	if rt.RevokedAt == nil {
+		t.Error("expected refresh tokens to be revoked")
+	}
+}
+
+func TestPasswordResetExpiry(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.passwordResetTTL = -time.Minute
+	if _, err := env.cfg.db.CreateUser(context.Background(), database.CreateUserParams{Email: "boots@example.com", Password: "hash"}); err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+
+	postJSON(env.cfg.handlerPasswordResetRequest, "/api/password_reset", `{"email":"boots@example.com"}`, "")
+	body := `{"token":"` + env.mailer.lastToken(t) + `","password":"new password"}`
+	if rr := postJSON(env.cfg.handlerPasswordResetConfirm, "/api/password_reset/confirm", body, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected expired token to get status 400, got %d", rr.Code)
+	}
+}
+
+func TestPasswordResetUnlocks(t *testing.T) {
+	env := newTestEnv(t)
+	if _, err := env.cfg.db.CreateUser(context.Background(), database.CreateUserParams{Email: "boots@example.com", Password: mustHash(t, "old password")}); err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+	login := func(password string) int {
+		return postJSON(env.cfg.handlerLogin, "/api/login", `{"email":"boots@example.com","password":"`+password+`"}`, "").Code
+	}
+
+	for i := 0; i < env.cfg.loginMaxFailures; i++ {
+		login("wrong")
+	}
+	if code := login("old password"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected account to be locked, got status %d", code)
+	}
+
+	postJSON(env.cfg.handlerPasswordResetRequest, "/api/password_reset", `{"email":"boots@example.com"}`, "")
+	body := `{"token":"` + env.mailer.lastToken(t) + `","password":"new password"}`
+	if rr := postJSON(env.cfg.handlerPasswordResetConfirm, "/api/password_reset/confirm", body, ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if code := login("new password"); code != http.StatusOK {
+		t.Errorf("expected reset to unlock the account, got status %d", code)
+	}
+}
+
+func TestUserProfile(t *testing.T) {
+	ctx := context.Background()
+
+	// newUser creates a user with password "password" and returns it with
+	// an access token.
+	newUser := func(t *testing.T, env *testEnv, email string) (*database.User, string) {
+		t.Helper()
+		user, err := env.cfg.db.CreateUser(ctx, database.CreateUserParams{Email: email, Password: mustHash(t, "password")})
+		if err != nil {
+			t.Fatalf("could not create user: %v", err)
+		}
+		return user, env.tokenFor(t, user.ID)
+	}
+
+	send := func(h http.HandlerFunc, method, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/users/me", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		return rr
+	}
+
+	t.Run("get me", func(t *testing.T) {
+		env := newTestEnv(t)
+		user, token := newUser(t, env, "boots@example.com")
+
+		rr := send(env.cfg.handlerUserGet, http.MethodGet, "", token)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		var got database.User
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("could not decode user: %v", err)
+		}
+		if got.ID != user.ID || got.Email != user.Email {
+			t.Errorf("expected %s, got %+v", user.Email, got)
+		}
+		if strings.Contains(rr.Body.String(), "password") {
+			t.Error("password hash must not be returned")
+		}
+	})
+
+	t.Run("change email", func(t *testing.T) {
+		env := newTestEnv(t)
+		user, token := newUser(t, env, "boots@example.com")
+		newUser(t, env, "taken@example.com")
+		if _, err := env.cfg.db.MarkEmailVerified(ctx, user.ID, user.Email); err != nil {
+			t.Fatalf("could not verify email: %v", err)
+		}
+
+		if rr := send(env.cfg.handlerUserEmailUpdate, http.MethodPut, `{"email":"new@example.com","password":"wrong"}`, token); rr.Code != http.StatusForbidden {
+			t.Errorf("expected wrong password to get status 403, got %d", rr.Code)
+		}
+		if rr := send(env.cfg.handlerUserEmailUpdate, http.MethodPut, `{"email":"taken@example.com","password":"password"}`, token); rr.Code != http.StatusConflict {
+			t.Errorf("expected taken email to get status 409, got %d", rr.Code)
+		}
+
+		rr := send(env.cfg.handlerUserEmailUpdate, http.MethodPut, `{"email":"new@example.com","password":"password"}`, token)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		stored, err := env.cfg.db.GetUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("could not get user: %v", err)
+		}
+		if stored.Email != "new@example.com" || stored.EmailVerifiedAt != nil {
+			t.Errorf("expected unverified new email, got %q verified at %v", stored.Email, stored.EmailVerifiedAt)
+		}
+		if to := env.mailer.sent[len(env.mailer.sent)-1].To; to != "new@example.com" {
+			t.Errorf("expected verification email to the new address, got %q", to)
+		}
+	})
+
+	t.Run("change password", func(t *testing.T) {
+		env := newTestEnv(t)
+		user, token := newUser(t, env, "boots@example.com")
+		if _, err := env.cfg.db.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{
+			Token:     "refresh-token",
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(time.Hour),
+		}); err != nil {
+			t.Fatalf("could not create refresh token: %v", err)
+		}
+
+		if rr := send(env.cfg.handlerUserPasswordUpdate, http.MethodPut, `{"old_password":"wrong","new_password":"new password"}`, token); rr.Code != http.StatusForbidden {
+			t.Errorf("expected wrong old password to get status 403, got %d", rr.Code)
+		}
+		if rr := send(env.cfg.handlerUserPasswordUpdate, http.MethodPut, `{"old_password":"password","new_password":"new password"}`, token); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		stored, err := env.cfg.db.GetUser(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("could not get user: %v", err)
+		}
+		if match, _ := auth.CheckPasswordHash("new password", stored.Password); !match {
+			t.Error("expected password to be changed")
+		}
+		rt, err := env.cfg.db.GetRefreshToken(ctx, "refresh-token")
+		if err != nil {
+			t.Fatalf("could not get refresh token: %v", err)
+		}
+		if rt.RevokedAt == nil {
+			t.Error("expected refresh tokens to be revoked")
+		}
+	})
+
+	t.Run("delete account", func(t *testing.T) {
+		env := newTestEnv(t)
+		video, token := env.createVideo(t)
+		userID := video.UserID
+		if err := env.cfg.db.UpdateUserPassword(ctx, userID, mustHash(t, "password")); err != nil {
+			t.Fatalf("could not set password: %v", err)
+		}
+
+		req := newUploadRequest(t, "/api/video_upload/", video.ID.String(), token, "video", "video/mp4", []byte("video to delete"))
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUploadVideo(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("could not upload video: %s", rr.Body.String())
+		}
+
+		if rr := send(env.cfg.handlerUserDelete, http.MethodDelete, `{"password":"wrong"}`, token); rr.Code != http.StatusForbidden {
+			t.Errorf("expected wrong password to get status 403, got %d", rr.Code)
+		}
+		if rr := send(env.cfg.handlerUserDelete, http.MethodDelete, `{"password":"password"}`, token); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+
+		if user, err := env.cfg.db.GetUser(ctx, userID); !errors.Is(err, database.ErrNotFound) {
+			t.Errorf("expected user to be deleted, got %+v, %v", user, err)
+		}
+		if videos, err := env.cfg.db.GetVideos(ctx, userID); err != nil || len(videos) != 0 {
+			t.Errorf("expected videos to be deleted, got %d, %v", len(videos), err)
+		}
+		if keys := env.s3.keys(); len(keys) != 0 {
+			t.Errorf("expected stored video to be deleted, got %v", keys)
+		}
+		if rr := send(env.cfg.handlerUserGet, http.MethodGet, "", token); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected deleted user's token to get status 401, got %d", rr.Code)
+		}
+	})
+}
+
+func TestRequestValidation(t *testing.T) {
+	env := newTestEnv(t)
+	_, token := env.createVideo(t)
+
+	type fieldError struct {
+		Field   string `json:"field"`
+		Message string `json:"message"`
+	}
+	fields := func(t *testing.T, rr *httptest.ResponseRecorder) []string {
+		t.Helper()
+		var resp struct {
+			Code    string       `json:"code"`
+			Details []fieldError `json:"details"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+		if resp.Code != codeValidationFailed {
+			t.Errorf("expected code %q, got %q", codeValidationFailed, resp.Code)
+		}
+		var names []string
+		for _, f := range resp.Details {
+			names = append(names, f.Field)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name       string
+		h          http.HandlerFunc
+		body       string
+		wantStatus int
+		wantFields []string
+	}{
+		{
+			name:       "malformed json",
+			h:          env.cfg.handlerVideoMetaCreate,
+			body:       `{"title":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "empty body",
+			h:          env.cfg.handlerUsersCreate,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown field",
+			h:          env.cfg.handlerVideoMetaCreate,
+			body:       `{"title":"Boots","user_id":"00000000-0000-0000-0000-000000000000"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "wrong type",
+			h:          env.cfg.handlerLogin,
+			body:       `{"email":"boots@example.com","password":42}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "weak password and bad email",
+			h:          env.cfg.handlerUsersCreate,
+			body:       `{"email":"Boots <boots@example.com>","password":"password"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"email", "password"},
+		},
+		{
+			name:       "missing title",
+			h:          env.cfg.handlerVideoMetaCreate,
+			body:       `{"description":"A bear"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"title"},
+		},
+		{
+			name:       "long fields",
+			h:          env.cfg.handlerVideoMetaCreate,
+			body:       `{"title":"` + strings.Repeat("a", maxTitleLength+1) + `","description":"` + strings.Repeat("a", maxDescriptionLength+1) + `"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"title", "description"},
+		},
+		{
+			name:       "control characters",
+			h:          env.cfg.handlerVideoMetaCreate,
+			body:       `{"title":"Boots\u0000","description":"Line one\nLine two\u001b[31m","visibility":"secret"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantFields: []string{"title", "description", "visibility"},
+		},
+		{
+			name:       "valid video",
+			h:          env.cfg.handlerVideoMetaCreate,
+			body:       `{"title":"Boots","description":"A bear\n\twho likes honey"}`,
+			wantStatus: http.StatusCreated,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := postJSON(tc.h, "/", tc.body, token)
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, rr.Code, rr.Body.String())
+			}
+			if tc.wantFields == nil {
+				return
+			}
+			if got := fields(t, rr); !slices.Equal(got, tc.wantFields) {
+				t.Errorf("expected field errors for %v, got %v", tc.wantFields, got)
+			}
+		})
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	video, token := env.createVideo(t)
+	otherVideo, _ := env.createVideo(t)
+	missingID := uuid.NewString()
+
+	revoked := "revoked-token"
+	expired := "expired-token"
+	for _, rt := range []database.CreateRefreshTokenParams{
+		{Token: revoked, UserID: video.UserID, ExpiresAt: time.Now().Add(time.Hour)},
+		{Token: expired, UserID: video.UserID, ExpiresAt: time.Now().Add(-time.Hour)},
+	} {
+		if _, err := env.cfg.db.CreateRefreshToken(ctx, rt); err != nil {
+			t.Fatalf("could not create refresh token: %v", err)
+		}
+	}
+	if err := env.cfg.db.RevokeRefreshToken(ctx, revoked); err != nil {
+		t.Fatalf("could not revoke refresh token: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos/{videoID}", env.cfg.handlerVideoGet)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", env.cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", env.cfg.handlerUploadThumbnail)
+	mux.HandleFunc("POST /api/refresh", env.cfg.handlerRefresh)
+	mux.HandleFunc("POST /api/revoke", env.cfg.handlerRevoke)
+	h := requestIDMiddleware(mux)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "missing video", method: http.MethodGet, path: "/api/videos/" + missingID, wantStatus: http.StatusNotFound, wantCode: codeNotFound},
+		{name: "invalid video ID", method: http.MethodGet, path: "/api/videos/nope", wantStatus: http.StatusBadRequest, wantCode: codeInvalidRequest},
+		{name: "delete missing video", method: http.MethodDelete, path: "/api/videos/" + missingID, token: token, wantStatus: http.StatusNotFound, wantCode: codeNotFound},
+		{name: "delete other user's video", method: http.MethodDelete, path: "/api/videos/" + otherVideo.ID.String(), token: token, wantStatus: http.StatusForbidden, wantCode: codeForbidden},
+		{name: "upload to missing video", method: http.MethodPost, path: "/api/thumbnail_upload/" + missingID, token: token, wantStatus: http.StatusNotFound, wantCode: codeNotFound},
+		{name: "upload to other user's video", method: http.MethodPost, path: "/api/thumbnail_upload/" + otherVideo.ID.String(), token: token, wantStatus: http.StatusForbidden, wantCode: codeForbidden},
+		{name: "refresh without token", method: http.MethodPost, path: "/api/refresh", wantStatus: http.StatusUnauthorized, wantCode: codeUnauthenticated},
+		{name: "refresh with unknown token", method: http.MethodPost, path: "/api/refresh", token: "unknown", wantStatus: http.StatusUnauthorized, wantCode: codeInvalidToken},
+		{name: "refresh with revoked token", method: http.MethodPost, path: "/api/refresh", token: revoked, wantStatus: http.StatusUnauthorized, wantCode: codeInvalidToken},
+		{name: "refresh with expired token", method: http.MethodPost, path: "/api/refresh", token: expired, wantStatus: http.StatusUnauthorized, wantCode: codeInvalidToken},
+		{name: "revoke without token", method: http.MethodPost, path: "/api/revoke", wantStatus: http.StatusUnauthorized, wantCode: codeUnauthenticated},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set(requestIDHeader, "test-request")
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tc.wantStatus, rr.Code, rr.Body.String())
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected a JSON error, got Content-Type %q", ct)
+			}
+			var resp apiError
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("could not decode error: %v", err)
+			}
+			if resp.Code != tc.wantCode {
+				t.Errorf("expected code %q, got %q", tc.wantCode, resp.Code)
+			}
+			if resp.Message == "" {
+				t.Error("expected a message")
+			}
+			if resp.RequestID != "test-request" {
+				t.Errorf("expected request ID %q, got %q", "test-request", resp.RequestID)
+			}
+		})
+	}
+}
+
+func TestVideoGetPrivate(t *testing.T) {
+	env := newTestEnv(t)
+	video, token := env.createVideo(t)
+	video.Visibility = database.VisibilityPrivate
+	if err := env.cfg.db.UpdateVideo(context.Background(), &video); err != nil {
+		t.Fatalf("could not update video: %v", err)
+	}
+
+	get := func(query string, header http.Header) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+query, nil)
+		req.SetPathValue("videoID", video.ID.String())
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		env.cfg.handlerVideoGet(rr, req)
+		return rr.Code
+	}
+
+	if code := get("", http.Header{"Authorization": {"Bearer " + token}}); code != http.StatusOK {
+		t.Errorf("expected the owner to get status 200, got %d", code)
+	}
+	if code := get("", nil); code != http.StatusNotFound {
+		t.Errorf("expected status 404 without a token, got %d", code)
+	}
+	if code := get("", http.Header{"Authorization": {"Bearer " + env.tokenFor(t, uuid.New())}}); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for another user, got %d", code)
+	}
+	if code := get("?token="+token, nil); code != http.StatusNotFound {
+		t.Errorf("expected a token in the query string to be ignored, got %d", code)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	db := env.cfg.db
+
+	t.Run("getters", func(t *testing.T) {
+		missing := uuid.New()
+		getters := map[string]func() error{
+			"GetVideo": func() error {
+				_, err := db.GetVideo(ctx, missing)
+				return err
+			},
+			"GetUser": func() error {
+				_, err := db.GetUser(ctx, missing)
+				return err
+			},
+			"GetUserByEmail": func() error {
+				_, err := db.GetUserByEmail(ctx, "missing@example.com")
+				return err
+			},
+			"GetUserByRefreshToken": func() error {
+				_, err := db.GetUserByRefreshToken(ctx, "missing")
+				return err
+			},
+			"GetRefreshToken": func() error {
+				_, err := db.GetRefreshToken(ctx, "missing")
+				return err
+			},
+			"ConsumeUserToken": func() error {
+				_, err := db.ConsumeUserToken(ctx, "missing", database.TokenPurposeVerifyEmail)
+				return err
+			},
+		}
+		for name, get := range getters {
+			if err := get(); !errors.Is(err, database.ErrNotFound) {
+				t.Errorf("%s: expected ErrNotFound, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("video progress", func(t *testing.T) {
+		_, token := env.createVideo(t)
+		missingID := uuid.NewString()
+		req := httptest.NewRequest(http.MethodGet, "/api/videos/"+missingID+"/progress", nil)
+		req.SetPathValue("videoID", missingID)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerVideoProgress(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("unreferenced asset", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/assets/missing.png", nil)
+		req.SetPathValue("key", "missing.png")
+		rr := httptest.NewRecorder()
+		env.cfg.handlerAssetGet(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("login with unknown email", func(t *testing.T) {
+		rr := postJSON(env.cfg.handlerLogin, "/api/login", `{"email":"nobody@example.com","password":"password1"}`, "")
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d", rr.Code)
+		}
+		var resp apiError
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("could not decode error: %v", err)
+		}
+		if resp.Code != codeInvalidCredentials {
+			t.Errorf("expected code %q, got %q", codeInvalidCredentials, resp.Code)
+		}
+	})
+
+	t.Run("password reset for unknown email", func(t *testing.T) {
+		sent := len(env.mailer.sent)
+		rr := postJSON(env.cfg.handlerPasswordResetRequest, "/api/password_reset", `{"email":"nobody@example.com"}`, "")
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("expected status 202, got %d", rr.Code)
+		}
+		if len(env.mailer.sent) != sent {
+			t.Error("expected no email to be sent")
+		}
+	})
+
+	t.Run("deleted user", func(t *testing.T) {
+		video, token := env.createVideo(t)
+		if err := db.DeleteUser(ctx, video.UserID); err != nil {
+			t.Fatalf("could not delete user: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		env.cfg.handlerUserGet(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status 401, got %d", rr.Code)
+		}
+	})
+}
+
+func TestHandlerVideoMetaUpdate(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	video, token := env.createVideo(t)
+	_, otherToken := env.createVideo(t)
+
+	patch := func(videoID, body, token, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/videos/"+videoID, strings.NewReader(body))
+		req.SetPathValue("videoID", videoID)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rr := httptest.NewRecorder()
+		env.cfg.handlerVideoMetaUpdate(rr, req)
+		return rr
+	}
+
+	created := videoETag(video)
+	rr := patch(video.ID.String(), `{"title":"Boots the Bear"}`, token, created)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var updated database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+		t.Fatalf("could not decode video: %v", err)
+	}
+	if updated.Title != "Boots the Bear" || updated.Description != video.Description {
+		t.Errorf("expected only the title to change, got %q, %q", updated.Title, updated.Description)
+	}
+	if !updated.UpdatedAt.After(video.UpdatedAt) {
+		t.Errorf("expected updated_at to move past %v, got %v", video.UpdatedAt, updated.UpdatedAt)
+	}
+	etag := rr.Header().Get("ETag")
+	if etag == "" || etag == created {
+		t.Fatalf("expected a new ETag, got %q", etag)
+	}
+	stored, err := env.cfg.db.GetVideo(ctx, video.ID)
+	if err != nil {
+		t.Fatalf("could not get video: %v", err)
+	}
+	if stored.Title != "Boots the Bear" || videoETag(stored) != etag {
+		t.Errorf("expected stored video to match the response, got %q with ETag %s", stored.Title, videoETag(stored))
+	}
+
+	t.Run("stale If-Match", func(t *testing.T) {
+		rr := patch(video.ID.String(), `{"description":"Lost update"}`, token, created)
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Fatalf("expected status 412, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if got := rr.Header().Get("ETag"); got != etag {
+			t.Errorf("expected current ETag %s, got %s", etag, got)
+		}
+	})
+
+	t.Run("If-Match list and wildcard", func(t *testing.T) {
+		if rr := patch(video.ID.String(), `{"visibility":"private"}`, token, created+", "+etag); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if rr := patch(video.ID.String(), `{"visibility":"public"}`, token, "*"); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("concurrent update", func(t *testing.T) {
+		first, err := env.cfg.db.GetVideo(ctx, video.ID)
+		if err != nil {
+			t.Fatalf("could not get video: %v", err)
+		}
+		second := first
+		first.Title = "First"
+		if err := env.cfg.db.UpdateVideoIfUnmodified(ctx, &first, first.UpdatedAt); err != nil {
+			t.Fatalf("expected first update to succeed, got %v", err)
+		}
+		second.Title = "Second"
+		if err := env.cfg.db.UpdateVideoIfUnmodified(ctx, &second, second.UpdatedAt); !errors.Is(err, database.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+		missing := database.Video{ID: uuid.New()}
+		if err := env.cfg.db.UpdateVideo(ctx, &missing); !errors.Is(err, database.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	tests := []struct {
+		name       string
+		videoID    string
+		body       string
+		token      string
+		wantStatus int
+	}{
+		{name: "not the owner", videoID: video.ID.String(), body: `{"title":"Mine"}`, token: otherToken, wantStatus: http.StatusForbidden},
+		{name: "missing video", videoID: uuid.NewString(), body: `{"title":"Gone"}`, token: token, wantStatus: http.StatusNotFound},
+		{name: "empty title", videoID: video.ID.String(), body: `{"title":""}`, token: token, wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid visibility", videoID: video.ID.String(), body: `{"visibility":"unlisted"}`, token: token, wantStatus: http.StatusUnprocessableEntity},
+		{name: "unknown field", videoID: video.ID.String(), body: `{"user_id":"` + uuid.NewString() + `"}`, token: token, wantStatus: http.StatusBadRequest},
+		{name: "no token", videoID: video.ID.String(), body: `{"title":"Anon"}`, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if rr := patch(tc.videoID, tc.body, tc.token, ""); rr.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.wantStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestVideoTags(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	video, token := env.createVideo(t)
+	other, err := env.cfg.db.CreateVideo(ctx, database.CreateVideoParams{
+		Title:       "Boots again",
+		Description: "Another bear",
+		UserID:      video.UserID,
+	})
+	if err != nil {
+		t.Fatalf("could not create video: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/videos", env.cfg.handlerVideosRetrieve)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", env.cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("PUT /api/videos/{videoID}/tags", env.cfg.handlerVideoTagsSet)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/tags/{tag}", env.cfg.handlerVideoTagDelete)
+	mux.HandleFunc("GET /api/tags", env.cfg.handlerTagsList)
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	setTags := func(videoID uuid.UUID, body string) *httptest.ResponseRecorder {
+		return do(http.MethodPut, "/api/videos/"+videoID.String()+"/tags", body, token)
+	}
+	listVideos := func(query string) []string {
+		t.Helper()
+		rr := do(http.MethodGet, "/api/videos"+query, "", token)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var videos []database.Video
+		if err := json.Unmarshal(rr.Body.Bytes(), &videos); err != nil {
+			t.Fatalf("could not decode videos: %v", err)
+		}
+		var titles []string
+		for _, v := range videos {
+			titles = append(titles, v.Title)
+		}
+		slices.Sort(titles)
+		return titles
+	}
+
+	rr := setTags(video.ID, `{"tags":["Road Trip","bears","BEARS"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var tagged database.Video
+	if err := json.Unmarshal(rr.Body.Bytes(), &tagged); err != nil {
+		t.Fatalf("could not decode video: %v", err)
+	}
+	if want := []string{"bears", "road-trip"}; !slices.Equal(tagged.Tags, want) {
+		t.Errorf("expected tags %v, got %v", want, tagged.Tags)
+	}
+	if etag := rr.Header().Get("ETag"); etag == "" || etag == videoETag(video) {
+		t.Errorf("expected a new ETag, got %q", etag)
+	}
+	if rr := setTags(other.ID, `{"tags":["bears"]}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = do(http.MethodGet, "/api/tags", "", token)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var counts []database.TagCount
+	if err := json.Unmarshal(rr.Body.Bytes(), &counts); err != nil {
+		t.Fatalf("could not decode tags: %v", err)
+	}
+	if want := []database.TagCount{{Name: "bears", Count: 2}, {Name: "road-trip", Count: 1}}; !slices.Equal(counts, want) {
+		t.Errorf("expected tag counts %v, got %v", want, counts)
+	}
+
+	if got, want := listVideos("?tag=bears"), []string{"Boots", "Boots again"}; !slices.Equal(got, want) {
+		t.Errorf("expected videos %v, got %v", want, got)
+	}
+	if got, want := listVideos("?tag=bears&tag=Road+Trip"), []string{"Boots"}; !slices.Equal(got, want) {
+		t.Errorf("expected videos %v, got %v", want, got)
+	}
+	if got := listVideos("?tag=cats"); len(got) != 0 {
+		t.Errorf("expected no videos, got %v", got)
+	}
+	// Filters follow the rules for setting tags.
+	for query, field := range map[string]string{
+		"?tag=":                            "tag[0]",
+		"?tag=bears&tag=a,b":               "tag[1]",
+		"?tag=" + strings.Repeat("a", 33):  "tag[0]",
+		"?" + strings.Repeat("tag=a&", 21): "tag",
+	} {
+		rr := do(http.MethodGet, "/api/videos"+query, "", token)
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected status 422, got %d: %s", query, rr.Code, rr.Body.String())
+			continue
+		}
+		var resp struct {
+			Code    string            `json:"code"`
+			Details validation.Errors `json:"details"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+		if resp.Code != codeValidationFailed || len(resp.Details) == 0 || resp.Details[0].Field != field {
+			t.Errorf("%s: expected a validation error for %s, got %+v", query, field, resp)
+		}
+	}
+
+	t.Run("remove", func(t *testing.T) {
+		rr := do(http.MethodDelete, "/api/videos/"+video.ID.String()+"/tags/road-trip", "", token)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+		rr = do(http.MethodDelete, "/api/videos/"+video.ID.String()+"/tags/road-trip", "", token)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", rr.Code, rr.Body.String())
+		}
+		tags, err := env.cfg.db.GetUserTags(ctx, video.UserID)
+		if err != nil {
+			t.Fatalf("could not get tags: %v", err)
+		}
+		if want := []database.TagCount{{Name: "bears", Count: 2}}; !slices.Equal(tags, want) {
+			t.Errorf("expected tag counts %v, got %v", want, tags)
+		}
+	})
+
+	t.Run("delete video", func(t *testing.T) {
+		if rr := do(http.MethodDelete, "/api/videos/"+other.ID.String(), "", token); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+		tags, err := env.cfg.db.GetUserTags(ctx, video.UserID)
+		if err != nil {
+			t.Fatalf("could not get tags: %v", err)
+		}
+		if want := []database.TagCount{{Name: "bears", Count: 1}}; !slices.Equal(tags, want) {
+			t.Errorf("expected tag counts %v, got %v", want, tags)
+		}
+	})
+
+	_, otherToken := env.createVideo(t)
+	tests := []struct {
+		name       string
+		body       string
+		token      string
+		wantStatus int
+	}{
+		{name: "not the owner", body: `{"tags":["mine"]}`, token: otherToken, wantStatus: http.StatusForbidden},
+		{name: "empty tag", body: `{"tags":["  "]}`, token: token, wantStatus: http.StatusUnprocessableEntity},
+		{name: "invalid characters", body: `{"tags":["a,b"]}`, token: token, wantStatus: http.StatusUnprocessableEntity},
+		{name: "too long", body: `{"tags":["` + strings.Repeat("a", maxTagLength+1) + `"]}`, token: token, wantStatus: http.StatusUnprocessableEntity},
+		{name: "unknown field", body: `{"labels":["bears"]}`, token: token, wantStatus: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := do(http.MethodPut, "/api/videos/"+video.ID.String()+"/tags", tc.body, tc.token)
+			if rr.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.wantStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestPlaylists(t *testing.T) {
+	env := newTestEnv(t)
+	ctx := context.Background()
+	first, token := env.createVideo(t)
+	first.Thumbnail = &database.StoredObject{Backend: database.BackendLocal, Key: "first.png"}
+	if err := env.cfg.db.UpdateVideo(ctx, &first); err != nil {
+		t.Fatalf("could not update video: %v", err)
+	}
+	var videos []database.Video
+	for _, title := range []string{"second", "third"} {
+		video, err := env.cfg.db.CreateVideo(ctx, database.CreateVideoParams{Title: title, UserID: first.UserID})
+		if err != nil {
+			t.Fatalf("could not create video: %v", err)
+		}
+		videos = append(videos, video)
+	}
+	second, third := videos[0], videos[1]
+	foreign, otherToken := env.createVideo(t)
+	foreignPrivate, err := env.cfg.db.CreateVideo(ctx, database.CreateVideoParams{
+		Title:      "hidden",
+		UserID:     foreign.UserID,
+		Visibility: database.VisibilityPrivate,
+	})
+	if err != nil {
+		t.Fatalf("could not create video: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/playlists", env.cfg.handlerPlaylistCreate)
+	mux.HandleFunc("GET /api/playlists", env.cfg.handlerPlaylistsRetrieve)
+	mux.HandleFunc("GET /api/playlists/{playlistID}", env.cfg.handlerPlaylistGet)
+	mux.HandleFunc("PATCH /api/playlists/{playlistID}", env.cfg.handlerPlaylistUpdate)
+	mux.HandleFunc("DELETE /api/playlists/{playlistID}", env.cfg.handlerPlaylistDelete)
+	mux.HandleFunc("POST /api/playlists/{playlistID}/videos", env.cfg.handlerPlaylistVideoAdd)
+	mux.HandleFunc("PUT /api/playlists/{playlistID}/videos", env.cfg.handlerPlaylistReorder)
+	mux.HandleFunc("DELETE /api/playlists/{playlistID}/videos/{videoID}", env.cfg.handlerPlaylistVideoRemove)
+	mux.HandleFunc("POST /api/playlists/{playlistID}/videos/{videoID}/move", env.cfg.handlerPlaylistVideoMove)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", env.cfg.handlerVideoMetaDelete)
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	decode := func(t *testing.T, rr *httptest.ResponseRecorder, wantStatus int) playlistResponse {
+		t.Helper()
+		if rr.Code != wantStatus {
+			t.Fatalf("expected status %d, got %d: %s", wantStatus, rr.Code, rr.Body.String())
+		}
+		var playlist playlistResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &playlist); err != nil {
+			t.Fatalf("could not decode playlist: %v", err)
+		}
+		return playlist
+	}
+	titles := func(playlist playlistResponse) []string {
+		var titles []string
+		for _, video := range playlist.Videos {
+			titles = append(titles, video.Title)
+		}
+		return titles
+	}
+	create := func(t *testing.T, body string) playlistResponse {
+		t.Helper()
+		return decode(t, do(http.MethodPost, "/api/playlists", body, token), http.StatusCreated)
+	}
+	add := func(playlistID, videoID uuid.UUID, extra string) *httptest.ResponseRecorder {
+		body := `{"video_id":"` + videoID.String() + `"` + extra + `}`
+		return do(http.MethodPost, "/api/playlists/"+playlistID.String()+"/videos", body, token)
+	}
+
+	playlist := create(t, `{"title":"Bears","description":"All the bears"}`)
+	if playlist.Visibility != database.VisibilityPublic || len(playlist.Videos) != 0 {
+		t.Fatalf("expected an empty public playlist, got %+v", playlist)
+	}
+	path := "/api/playlists/" + playlist.ID.String()
+
+	decode(t, add(playlist.ID, first.ID, ""), http.StatusOK)
+	decode(t, add(playlist.ID, third.ID, ""), http.StatusOK)
+	decode(t, add(playlist.ID, foreign.ID, ""), http.StatusOK)
+	got := decode(t, add(playlist.ID, second.ID, `,"position":1`), http.StatusOK)
+	if want := []string{"Boots", "second", "third", "Boots"}; !slices.Equal(titles(got), want) {
+		t.Errorf("expected videos %v, got %v", want, titles(got))
+	}
+	if got.VideoCount != 4 || !got.UpdatedAt.After(playlist.UpdatedAt) {
+		t.Errorf("expected 4 videos and a later updated_at, got %d at %v", got.VideoCount, got.UpdatedAt)
+	}
+	if got.Videos[0].ThumbnailURL == nil || !strings.HasSuffix(*got.Videos[0].ThumbnailURL, "/assets/first.png") {
+		t.Errorf("expected embedded thumbnail URL, got %v", got.Videos[0].ThumbnailURL)
+	}
+
+	t.Run("add errors", func(t *testing.T) {
+		if rr := add(playlist.ID, first.ID, ""); rr.Code != http.StatusConflict {
+			t.Errorf("expected status 409 for a duplicate, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if rr := add(playlist.ID, foreignPrivate.ID, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for someone else's private video, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if rr := add(playlist.ID, first.ID, `,"position":-1`); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status 422 for a negative position, got %d: %s", rr.Code, rr.Body.String())
+		}
+		rr := do(http.MethodPost, path+"/videos", `{"video_id":"`+first.ID.String()+`"}`, otherToken)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status 403 for another user's playlist, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("visibility", func(t *testing.T) {
+		second.Visibility = database.VisibilityPrivate
+		if err := env.cfg.db.UpdateVideo(ctx, &second); err != nil {
+			t.Fatalf("could not update video: %v", err)
+		}
+		anon := decode(t, do(http.MethodGet, path, "", ""), http.StatusOK)
+		if want := []string{"Boots", "third", "Boots"}; !slices.Equal(titles(anon), want) {
+			t.Errorf("expected private video hidden from anonymous viewers, got %v", titles(anon))
+		}
+		owner := decode(t, do(http.MethodGet, path, "", token), http.StatusOK)
+		if len(owner.Videos) != 4 {
+			t.Errorf("expected the owner to see 4 videos, got %v", titles(owner))
+		}
+
+		rr := do(http.MethodPatch, path, `{"visibility":"private"}`, token)
+		if p := decode(t, rr, http.StatusOK); p.Visibility != database.VisibilityPrivate || p.Title != "Bears" {
+			t.Errorf("expected a private playlist titled Bears, got %q, %q", p.Visibility, p.Title)
+		}
+		if rr := do(http.MethodGet, path, "", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for anonymous viewers, got %d", rr.Code)
+		}
+		if rr := do(http.MethodGet, path, "", otherToken); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for other users, got %d", rr.Code)
+		}
+		if rr := do(http.MethodGet, path+"?token="+token, "", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected a token in the query string to be ignored, got %d", rr.Code)
+		}
+		if rr := do(http.MethodGet, path, "", "not-a-jwt"); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for an invalid token, got %d", rr.Code)
+		}
+		decode(t, do(http.MethodGet, path, "", token), http.StatusOK)
+		if rr := do(http.MethodPatch, path, `{"visibility":"unlisted"}`, token); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status 422, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("reorder", func(t *testing.T) {
+		order := func(videos ...database.Video) string {
+			ids := make([]string, len(videos))
+			for i, v := range videos {
+				ids[i] = `"` + v.ID.String() + `"`
+			}
+			return `{"video_ids":[` + strings.Join(ids, ",") + `]}`
+		}
+		got := decode(t, do(http.MethodPut, path+"/videos", order(foreign, third, second, first), token), http.StatusOK)
+		if want := []string{"Boots", "third", "second", "Boots"}; !slices.Equal(titles(got), want) || got.Videos[0].ID != foreign.ID {
+			t.Errorf("expected videos %v starting with %s, got %v", want, foreign.ID, titles(got))
+		}
+		for name, tc := range map[string]struct {
+			body    string
+			message string
+		}{
+			"missing":   {order(foreign, third, second), "must list every video in the playlist"},
+			"duplicate": {order(foreign, third, second, second), "must not list a video more than once"},
+			"unknown":   {order(foreign, third, second, foreignPrivate), "must only list videos in the playlist"},
+		} {
+			rr := do(http.MethodPut, path+"/videos", tc.body, token)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("%s: expected status 422, got %d: %s", name, rr.Code, rr.Body.String())
+				continue
+			}
+			var resp struct {
+				Details validation.Errors `json:"details"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			want := validation.Errors{{Field: "video_ids", Message: tc.message}}
+			if !slices.Equal(resp.Details, want) {
+				t.Errorf("%s: expected details %v, got %v", name, want, resp.Details)
+			}
+		}
+		// The handler's check can race with other changes; the update
+		// itself still refuses an order that doesn't match.
+		stale := []uuid.UUID{foreign.ID, third.ID, second.ID}
+		if err := env.cfg.db.ReorderPlaylist(ctx, &playlist.Playlist, stale); !errors.Is(err, database.ErrConflict) {
+			t.Errorf("expected ErrConflict for a stale order, got %v", err)
+		}
+		after := decode(t, do(http.MethodGet, path, "", token), http.StatusOK)
+		if !slices.Equal(titles(after), titles(got)) {
+			t.Errorf("expected failed reorders to change nothing, got %v", titles(after))
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		move := func(videoID uuid.UUID, body string) *httptest.ResponseRecorder {
+			return do(http.MethodPost, path+"/videos/"+videoID.String()+"/move", body, token)
+		}
+		got := decode(t, move(first.ID, `{"position":0}`), http.StatusOK)
+		if got.Videos[0].ID != first.ID || len(got.Videos) != 4 {
+			t.Errorf("expected %s first, got %v", first.ID, got.Videos)
+		}
+		got = decode(t, move(first.ID, `{}`), http.StatusOK)
+		if got.Videos[3].ID != first.ID {
+			t.Errorf("expected %s last, got %v", first.ID, got.Videos)
+		}
+
+		other := create(t, `{"title":"Other"}`)
+		got = decode(t, move(third.ID, `{"playlist_id":"`+other.ID.String()+`"}`), http.StatusOK)
+		if got.ID != other.ID || !slices.Equal(titles(got), []string{"third"}) {
+			t.Errorf("expected third in the other playlist, got %s with %v", got.ID, titles(got))
+		}
+		source := decode(t, do(http.MethodGet, path, "", token), http.StatusOK)
+		if source.VideoCount != 3 || slices.Contains(titles(source), "third") {
+			t.Errorf("expected third moved out of the playlist, got %v", titles(source))
+		}
+		if rr := move(third.ID, `{}`); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404 for a video not in the playlist, got %d: %s", rr.Code, rr.Body.String())
+		}
+		decode(t, add(other.ID, first.ID, ""), http.StatusOK)
+		if rr := move(first.ID, `{"playlist_id":"`+other.ID.String()+`"}`); rr.Code != http.StatusConflict {
+			t.Errorf("expected status 409 for a video already in the target, got %d: %s", rr.Code, rr.Body.String())
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if rr := do(http.MethodDelete, path+"/videos/"+foreign.ID.String(), "", token); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if rr := do(http.MethodDelete, path+"/videos/"+foreign.ID.String(), "", token); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if rr := do(http.MethodDelete, "/api/videos/"+second.ID.String(), "", token); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+		got := decode(t, do(http.MethodGet, path, "", token), http.StatusOK)
+		if got.VideoCount != 1 || !slices.Equal(titles(got), []string{"Boots"}) {
+			t.Errorf("expected only Boots left, got %d: %v", got.VideoCount, titles(got))
+		}
+		// Positions stay contiguous, so inserting at 1 appends.
+		decode(t, add(playlist.ID, foreign.ID, `,"position":0`), http.StatusOK)
+		got = decode(t, add(playlist.ID, third.ID, `,"position":1`), http.StatusOK)
+		if got.Videos[1].ID != third.ID || got.Videos[2].ID != first.ID {
+			t.Errorf("expected third between the two Boots, got %v", got.Videos)
+		}
+	})
+
+	t.Run("list and delete", func(t *testing.T) {
+		rr := do(http.MethodGet, "/api/playlists", "", token)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var playlists []database.Playlist
+		if err := json.Unmarshal(rr.Body.Bytes(), &playlists); err != nil {
+			t.Fatalf("could not decode playlists: %v", err)
+		}
+		if len(playlists) != 2 || playlists[0].ID != playlist.ID || playlists[0].VideoCount != 3 {
+			t.Errorf("expected the most recently updated playlist first with 3 videos, got %+v", playlists)
+		}
+
+		if rr := do(http.MethodDelete, path, "", otherToken); rr.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", rr.Code)
+		}
+		if rr := do(http.MethodDelete, path, "", token); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d: %s", rr.Code, rr.Body.String())
+		}
+		if _, err := env.cfg.db.GetPlaylist(ctx, playlist.ID); !errors.Is(err, database.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+		if _, err := env.cfg.db.GetVideo(ctx, first.ID); err != nil {
+			t.Errorf("expected the videos to survive, got %v", err)
+		}
+	})
+
+	t.Run("deleting a user", func(t *testing.T) {
+		newVideo := func(title string, userID uuid.UUID) database.Video {
+			video, err := env.cfg.db.CreateVideo(ctx, database.CreateVideoParams{Title: title, UserID: userID})
+			if err != nil {
+				t.Fatalf("could not create video: %v", err)
+			}
+			return video
+		}
+		d, _ := env.createVideo(t)
+		a, b := newVideo("a", d.UserID), newVideo("b", d.UserID)
+		c, e := newVideo("c", first.UserID), newVideo("e", first.UserID)
+
+		playlist := create(t, `{"title":"Mixed"}`)
+		decode(t, add(playlist.ID, d.ID, ""), http.StatusOK)
+		decode(t, add(playlist.ID, a.ID, `,"position":0`), http.StatusOK)
+		decode(t, add(playlist.ID, b.ID, `,"position":1`), http.StatusOK)
+		decode(t, add(playlist.ID, c.ID, `,"position":2`), http.StatusOK)
+		decode(t, add(playlist.ID, e.ID, ""), http.StatusOK)
+
+		if err := env.cfg.db.DeleteUser(ctx, d.UserID); err != nil {
+			t.Fatalf("could not delete user: %v", err)
+		}
+
+		got := decode(t, do(http.MethodGet, "/api/playlists/"+playlist.ID.String(), "", token), http.StatusOK)
+		if want := []string{"c", "e"}; !slices.Equal(titles(got), want) {
+			t.Errorf("expected videos %v, got %v", want, titles(got))
+		}
+		rows, err := env.openDB(t).Query(`SELECT position FROM playlists_videos WHERE playlist_id = ? ORDER BY position`, playlist.ID)
+		if err != nil {
+			t.Fatalf("could not read positions: %v", err)
+		}
+		defer rows.Close()
+		var positions []int
+		for rows.Next() {
+			var position int
+			if err := rows.Scan(&position); err != nil {
+				t.Fatalf("could not read position: %v", err)
+			}
+			positions = append(positions, position)
+		}
+		if want := []int{0, 1}; !slices.Equal(positions, want) {
+			t.Errorf("expected positions %v, got %v", want, positions)
+		}
+	})
+}
+
+func TestReadyzS3Check(t *testing.T) {
+	env := newTestEnv(t)
+	env.s3.err = errors.New("no credentials")
+
+	readyz := func() readinessResponse {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		env.cfg.handlerReadyz(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var resp readinessResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("could not decode readiness: %v", err)
+		}
+		return resp
+	}
+
+	if s3, ok := readyz().Checks["s3"]; !ok || s3.Status != "unavailable" {
+		t.Errorf("expected a failing s3 check with the S3 backend, got %+v", s3)
+	}
+	env.cfg.videoBackend = database.BackendLocal
+	if s3, ok := readyz().Checks["s3"]; ok {
+		t.Errorf("expected no s3 check with the local backend, got %+v", s3)
+	}
+}
+
+func mustHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		t.Fatalf("could not hash password: %v", err)
+	}
+	return hash
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// readinessCheckTimeout bounds each dependency check so a hung dependency
+// can't stall the load balancer's probe.
+const readinessCheckTimeout = 5 * time.Second
+
+type dependencyStatus struct {
+	Status     string  `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Status string                      `json:"status"`
+	Checks map[string]dependencyStatus `json:"checks"`
+}
+
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"database": cfg.db.Ping,
+		"assets":   cfg.checkAssetsWritable,
+		"ffmpeg":   checkBinary("ffmpeg"),
+		"ffprobe":  checkBinary("ffprobe"),
+	}
+	// With the local backend new uploads never touch S3, so a deployment
+	// without S3 credentials can still be ready.
+	if cfg.videoBackend == database.BackendS3 {
+		checks["s3"] = cfg.checkS3Bucket
+	}
+
+	resp := readinessResponse{
+		Status: "ok",
+		Checks: make(map[string]dependencyStatus, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), readinessCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			status := dependencyStatus{
+				Status:     "ok",
+				DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				status.Status = "unavailable"
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[name] = status
+			if err != nil {
+				resp.Status = "unavailable"
+			}
+		}()
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	if resp.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, resp)
+}
+
+func (cfg *apiConfig) checkAssetsWritable(ctx context.Context) error {
+	f, err := os.CreateTemp(cfg.assetsRoot, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (cfg *apiConfig) checkS3Bucket(ctx context.Context) error {
+	_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: &cfg.s3Bucket,
+	})
+	return err
+}
+
+func checkBinary(name string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := exec.LookPath(name)
+		return err
+	}
+}
@@ -0,0 +1,511 @@
+// Package config loads the server configuration from defaults, an optional
+// YAML file, environment variables and command line flags, in increasing
+// order of precedence.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	DBPath       string
+	JWTSecret    string
+	Platform     string
+	FilepathRoot string
+	AssetsRoot   string
+	Port         string
+
+	// PublicBaseURL is the externally visible origin of this server, used to
+	// build links to locally served assets. Defaults to
+	// http://localhost:<port>.
+	PublicBaseURL string
+	// AssetsBaseURL is prefixed to asset keys to build thumbnail URLs, set
+	// it to a CDN origin to serve assets from there. Defaults to
+	// PublicBaseURL + "/assets".
+	AssetsBaseURL string
+	// TrustedProxies are the reverse proxies in front of the server, as
+	// single IPs or CIDR ranges. Requests they forward are attributed to the
+	// client named in X-Forwarded-For; the header is ignored when empty.
+	TrustedProxies []netip.Prefix
+
+	S3Bucket         string
+	S3Region         string
+	S3CfDistribution string
+
+	// VideoBackend is where processed videos are stored, "s3" or "local"
+	// (the assets directory).
+	VideoBackend string
+
+	MaxVideoUploadBytes     int64
+	MaxThumbnailUploadBytes int64
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	// LoginMaxFailures consecutive failed sign-ins lock an account for
+	// LoginLockout, doubling with every further failure up to
+	// LoginLockoutMax.
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+	LoginLockoutMax  time.Duration
+
+	// MailBackend is "file", which logs messages or writes them to MailDir
+	// for local development, or "smtp".
+	MailBackend  string
+	MailDir      string
+	MailFrom     string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+
+	EmailVerificationTTL time.Duration
+	PasswordResetTTL     time.Duration
+
+	CacheMaxAge time.Duration
+
+	FFprobeTimeout  time.Duration
+	FFmpegTimeout   time.Duration
+	S3UploadTimeout time.Duration
+	ShutdownTimeout time.Duration
+
+	LogLevel      string
+	LogFormat     string
+	TraceExporter string
+}
+
+// Default returns the configuration used for any setting that isn't
+// provided. Settings without a sensible default are left empty and must be
+// set.
+func Default() Config {
+	return Config{
+		MaxVideoUploadBytes:     1 << 30,
+		MaxThumbnailUploadBytes: 10 << 20,
+		AccessTokenTTL:          30 * 24 * time.Hour,
+		RefreshTokenTTL:         60 * 24 * time.Hour,
+		LoginMaxFailures:        5,
+		LoginLockout:            time.Minute,
+		LoginLockoutMax:         24 * time.Hour,
+		MailBackend:             "file",
+		MailFrom:                "Tubely <no-reply@localhost>",
+		EmailVerificationTTL:    48 * time.Hour,
+		PasswordResetTTL:        time.Hour,
+		CacheMaxAge:             time.Hour,
+		FFprobeTimeout:          30 * time.Second,
+		FFmpegTimeout:           5 * time.Minute,
+		S3UploadTimeout:         10 * time.Minute,
+		ShutdownTimeout:         30 * time.Second,
+		VideoBackend:            "s3",
+		LogLevel:                "info",
+		LogFormat:               "text",
+		TraceExporter:           "none",
+	}
+}
+
+// setting describes one configuration value and every way it can be set.
+type setting struct {
+	key   string // YAML key, flags use the same name with dashes
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"db_path", "DB_PATH", "path to the SQLite database file", (*stringValue)(&c.DBPath)},
+		{"jwt_secret", "JWT_SECRET", "secret used to sign access tokens", (*stringValue)(&c.JWTSecret)},
+		{"platform", "PLATFORM", `deployment platform, "dev" enables /admin/reset`, (*stringValue)(&c.Platform)},
+		{"filepath_root", "FILEPATH_ROOT", "directory holding the web app served on /app/", (*stringValue)(&c.FilepathRoot)},
+		{"assets_root", "ASSETS_ROOT", "directory where uploaded thumbnails are stored", (*stringValue)(&c.AssetsRoot)},
+		{"port", "PORT", "port to listen on", (*stringValue)(&c.Port)},
+		{"public_base_url", "PUBLIC_BASE_URL", "public origin used in asset URLs (default http://localhost:<port>)", (*stringValue)(&c.PublicBaseURL)},
+		{"assets_base_url", "ASSETS_BASE_URL", "base URL assets are served from, e.g. a CDN (default <public_base_url>/assets)", (*stringValue)(&c.AssetsBaseURL)},
+		{"trusted_proxies", "TRUSTED_PROXIES", "comma-separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-For is trusted", (*prefixListValue)(&c.TrustedProxies)},
+		{"s3_bucket", "S3_BUCKET", "S3 bucket videos are uploaded to", (*stringValue)(&c.S3Bucket)},
+		{"s3_region", "S3_REGION", "AWS region of the S3 bucket", (*stringValue)(&c.S3Region)},
+		{"s3_cf_distro", "S3_CF_DISTRO", "CloudFront distribution domain serving the bucket", (*stringValue)(&c.S3CfDistribution)},
+		{"video_backend", "VIDEO_BACKEND", "where videos are stored, s3 or local", (*stringValue)(&c.VideoBackend)},
+		{"max_video_upload_size", "MAX_VIDEO_UPLOAD_SIZE", "largest accepted video upload, e.g. 1GiB", (*byteSizeValue)(&c.MaxVideoUploadBytes)},
+		{"max_thumbnail_upload_size", "MAX_THUMBNAIL_UPLOAD_SIZE", "largest accepted thumbnail upload, e.g. 10MiB", (*byteSizeValue)(&c.MaxThumbnailUploadBytes)},
+		{"access_token_ttl", "ACCESS_TOKEN_TTL", "lifetime of access tokens", (*durationValue)(&c.AccessTokenTTL)},
+		{"refresh_token_ttl", "REFRESH_TOKEN_TTL", "lifetime of refresh tokens", (*durationValue)(&c.RefreshTokenTTL)},
+		{"login_max_failures", "LOGIN_MAX_FAILURES", "consecutive failed sign-ins before an account is locked", (*intValue)(&c.LoginMaxFailures)},
+		{"login_lockout", "LOGIN_LOCKOUT", "first lockout duration, doubled with each further failure", (*durationValue)(&c.LoginLockout)},
+		{"login_lockout_max", "LOGIN_LOCKOUT_MAX", "longest lockout", (*durationValue)(&c.LoginLockoutMax)},
+		{"mail_backend", "MAIL_BACKEND", "file or smtp", (*stringValue)(&c.MailBackend)},
+		{"mail_dir", "MAIL_DIR", "directory the file mail backend writes messages to, logged only if empty", (*stringValue)(&c.MailDir)},
+		{"mail_from", "MAIL_FROM", "From address of outgoing mail", (*stringValue)(&c.MailFrom)},
+		{"smtp_addr", "SMTP_ADDR", "host:port of the SMTP server", (*stringValue)(&c.SMTPAddr)},
+		{"smtp_username", "SMTP_USERNAME", "SMTP username, no authentication if empty", (*stringValue)(&c.SMTPUsername)},
+		{"smtp_password", "SMTP_PASSWORD", "SMTP password", (*stringValue)(&c.SMTPPassword)},
+		{"email_verification_ttl", "EMAIL_VERIFICATION_TTL", "lifetime of email verification links", (*durationValue)(&c.EmailVerificationTTL)},
+		{"password_reset_ttl", "PASSWORD_RESET_TTL", "lifetime of password reset links", (*durationValue)(&c.PasswordResetTTL)},
+		{"cache_max_age", "CACHE_MAX_AGE", "Cache-Control max-age for served assets", (*durationValue)(&c.CacheMaxAge)},
+		{"ffprobe_timeout", "FFPROBE_TIMEOUT", "time limit for probing an upload", (*durationValue)(&c.FFprobeTimeout)},
+		{"ffmpeg_timeout", "FFMPEG_TIMEOUT", "time limit for processing an upload with ffmpeg", (*durationValue)(&c.FFmpegTimeout)},
+		{"s3_upload_timeout", "S3_UPLOAD_TIMEOUT", "time limit for uploading a video to S3", (*durationValue)(&c.S3UploadTimeout)},
+		{"shutdown_timeout", "SHUTDOWN_TIMEOUT", "how long to wait for in-flight requests on shutdown", (*durationValue)(&c.ShutdownTimeout)},
+		{"log_level", "LOG_LEVEL", "debug, info, warn or error", (*stringValue)(&c.LogLevel)},
+		{"log_format", "LOG_FORMAT", "text or json", (*stringValue)(&c.LogFormat)},
+		{"trace_exporter", "OTEL_TRACES_EXPORTER", "none, stdout or otlp", (*stringValue)(&c.TraceExporter)},
+	}
+}
+
+// Load builds the configuration from args (usually os.Args[1:]), the
+// environment and the YAML file named by -config or CONFIG_FILE. Every
+// problem found is reported in the returned error, not just the first.
+func Load(args []string) (Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	// Flags must win over the file and the environment, so their values are
+	// only recorded while parsing and applied at the end.
+	explicitFlags := map[string]string{}
+	fs := flag.NewFlagSet("tubely", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file (env CONFIG_FILE)")
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		fs.Var(&recordedFlag{name: flagName(s.key), value: s.value, values: explicitFlags}, flagName(s.key), usage)
+	}
+	var errs []error
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return Config{}, err
+		}
+		errs = append(errs, err)
+	}
+
+	if *configFile != "" {
+		errs = append(errs, loadFile(*configFile, settings)...)
+	}
+
+	for _, s := range settings {
+		if val, ok := os.LookupEnv(s.env); ok && val != "" {
+			if err := s.value.Set(val); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if val, ok := explicitFlags[flagName(s.key)]; ok {
+			if err := s.value.Set(val); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", flagName(s.key), err))
+			}
+		}
+	}
+
+	if cfg.PublicBaseURL == "" && cfg.Port != "" {
+		cfg.PublicBaseURL = "http://localhost:" + cfg.Port
+	}
+	cfg.PublicBaseURL = strings.TrimSuffix(cfg.PublicBaseURL, "/")
+	if cfg.AssetsBaseURL == "" && cfg.PublicBaseURL != "" {
+		cfg.AssetsBaseURL = cfg.PublicBaseURL + "/assets"
+	}
+	cfg.AssetsBaseURL = strings.TrimSuffix(cfg.AssetsBaseURL, "/")
+
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+func loadFile(path string, settings []setting) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("could not read config file: %w", err)}
+	}
+
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return []error{fmt.Errorf("could not parse config file %s: %w", path, err)}
+	}
+
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+
+	var errs []error
+	for key, val := range raw {
+		s, ok := byKey[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %q", path, key))
+			continue
+		}
+		if list, ok := val.([]any); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			val = strings.Join(items, ",")
+		}
+		if err := s.value.Set(fmt.Sprint(val)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: %w", path, key, err))
+		}
+	}
+	return errs
+}
+
+func (c Config) validate() []error {
+	var errs []error
+	required := map[string]string{
+		"DB_PATH":       c.DBPath,
+		"JWT_SECRET":    c.JWTSecret,
+		"PLATFORM":      c.Platform,
+		"FILEPATH_ROOT": c.FilepathRoot,
+		"ASSETS_ROOT":   c.AssetsRoot,
+		"PORT":          c.Port,
+	}
+	// A purely local deployment never talks to S3.
+	if c.VideoBackend == "s3" {
+		required["S3_BUCKET"] = c.S3Bucket
+		required["S3_REGION"] = c.S3Region
+		required["S3_CF_DISTRO"] = c.S3CfDistribution
+	}
+	for _, s := range c.settings() {
+		if val, ok := required[s.env]; ok && val == "" {
+			errs = append(errs, fmt.Errorf("%s must be set", s.env))
+		}
+	}
+
+	if c.Port != "" {
+		if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Errorf("PORT must be a number between 1 and 65535, got %q", c.Port))
+		}
+	}
+
+	urls := []struct {
+		env string
+		val string
+	}{
+		{"PUBLIC_BASE_URL", c.PublicBaseURL},
+		{"ASSETS_BASE_URL", c.AssetsBaseURL},
+	}
+	for _, u := range urls {
+		if u.val != "" && !isHTTPURL(u.val) {
+			errs = append(errs, fmt.Errorf("%s must be an absolute http(s) URL, got %q", u.env, u.val))
+		}
+	}
+
+	positive := []struct {
+		env string
+		ok  bool
+	}{
+		{"MAX_VIDEO_UPLOAD_SIZE", c.MaxVideoUploadBytes > 0},
+		{"MAX_THUMBNAIL_UPLOAD_SIZE", c.MaxThumbnailUploadBytes > 0},
+		{"ACCESS_TOKEN_TTL", c.AccessTokenTTL > 0},
+		{"REFRESH_TOKEN_TTL", c.RefreshTokenTTL > 0},
+		{"LOGIN_MAX_FAILURES", c.LoginMaxFailures > 0},
+		{"LOGIN_LOCKOUT", c.LoginLockout > 0},
+		{"EMAIL_VERIFICATION_TTL", c.EmailVerificationTTL > 0},
+		{"PASSWORD_RESET_TTL", c.PasswordResetTTL > 0},
+		{"CACHE_MAX_AGE", c.CacheMaxAge >= 0},
+		{"FFPROBE_TIMEOUT", c.FFprobeTimeout > 0},
+		{"FFMPEG_TIMEOUT", c.FFmpegTimeout > 0},
+		{"S3_UPLOAD_TIMEOUT", c.S3UploadTimeout > 0},
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout > 0},
+	}
+	for _, p := range positive {
+		if !p.ok {
+			errs = append(errs, fmt.Errorf("%s must be positive", p.env))
+		}
+	}
+
+	if c.LoginLockoutMax < c.LoginLockout {
+		errs = append(errs, errors.New("LOGIN_LOCKOUT_MAX must not be shorter than LOGIN_LOCKOUT"))
+	}
+
+	switch c.MailBackend {
+	case "file":
+	case "smtp":
+		if _, _, err := net.SplitHostPort(c.SMTPAddr); err != nil {
+			errs = append(errs, fmt.Errorf("SMTP_ADDR must be host:port when MAIL_BACKEND is smtp, got %q", c.SMTPAddr))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("MAIL_BACKEND must be file or smtp, got %q", c.MailBackend))
+	}
+	if _, err := mail.ParseAddress(c.MailFrom); err != nil {
+		errs = append(errs, fmt.Errorf("MAIL_FROM must be an email address, got %q", c.MailFrom))
+	}
+
+	switch c.VideoBackend {
+	case "s3", "local":
+	default:
+		errs = append(errs, fmt.Errorf("VIDEO_BACKEND must be s3 or local, got %q", c.VideoBackend))
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("LOG_LEVEL must be one of debug, info, warn or error, got %q", c.LogLevel))
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be text or json, got %q", c.LogFormat))
+	}
+	switch c.TraceExporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("OTEL_TRACES_EXPORTER must be one of none, stdout or otlp, got %q", c.TraceExporter))
+	}
+
+	return errs
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// recordedFlag stores the values given on the command line in values
+// instead of setting them, so Load can apply them last and report invalid
+// ones along with every other problem.
+type recordedFlag struct {
+	name   string
+	value  flag.Value
+	values map[string]string
+}
+
+func (f *recordedFlag) Set(s string) error { f.values[f.name] = s; return nil }
+
+// String shows the default in the usage message.
+func (f *recordedFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return f.value.String()
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
+
+type byteSizeValue int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"GB", 1e9},
+	{"MB", 1e6},
+	{"KB", 1e3},
+	{"B", 1},
+}
+
+// Set parses a size such as "1GiB", "500MB" or a plain number of bytes.
+func (v *byteSizeValue) Set(s string) error {
+	s = strings.TrimSpace(s)
+	raw := s
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.size
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/multiplier || n < math.MinInt64/multiplier {
+		return fmt.Errorf("size %q is too large", raw)
+	}
+	*v = byteSizeValue(n * multiplier)
+	return nil
+}
+
+func (v *byteSizeValue) String() string {
+	n := int64(*v)
+	for _, unit := range byteSizeUnits {
+		if n != 0 && n%unit.size == 0 && unit.size > 1 && strings.HasSuffix(unit.suffix, "iB") {
+			return strconv.FormatInt(n/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+type prefixListValue []netip.Prefix
+
+// Set parses a comma-separated list of IPs and CIDR ranges, replacing any
+// previous value.
+func (v *prefixListValue) Set(s string) error {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR range %q", item)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return fmt.Errorf("invalid IP address %q", item)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	*v = prefixes
+	return nil
+}
+
+func (v *prefixListValue) String() string {
+	items := make([]string, len(*v))
+	for i, prefix := range *v {
+		items[i] = prefix.String()
+	}
+	return strings.Join(items, ",")
+}
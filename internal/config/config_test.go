@@ -0,0 +1,279 @@
+package config
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requiredYAML sets every setting that has no default.
+const requiredYAML = `
+db_path: tubely.db
+jwt_secret: secret
+platform: dev
+filepath_root: ./app
+assets_root: ./assets
+s3_bucket: bucket
+s3_region: us-east-2
+s3_cf_distro: cdn.example.com
+`
+
+// clearEnv unsets the environment variables of every setting for the
+// duration of the test, so the developer's environment can't leak in.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	for _, s := range (&Config{}).settings() {
+		t.Setenv(s.env, "")
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("could not write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		env         map[string]string
+		args        []string
+		wantPort    string
+		wantLockout time.Duration
+	}{
+		{
+			name:        "defaults",
+			file:        "port: 8091",
+			wantPort:    "8091",
+			wantLockout: time.Minute,
+		},
+		{
+			name:        "file over defaults",
+			file:        "port: 8091\nlogin_lockout: 2m",
+			wantPort:    "8091",
+			wantLockout: 2 * time.Minute,
+		},
+		{
+			name:        "env over file",
+			file:        "port: 8091\nlogin_lockout: 2m",
+			env:         map[string]string{"PORT": "9000", "LOGIN_LOCKOUT": "3m"},
+			wantPort:    "9000",
+			wantLockout: 3 * time.Minute,
+		},
+		{
+			name:        "flags over env",
+			file:        "port: 8091\nlogin_lockout: 2m",
+			env:         map[string]string{"PORT": "9000", "LOGIN_LOCKOUT": "3m"},
+			args:        []string{"-port", "9100", "-login-lockout=4m"},
+			wantPort:    "9100",
+			wantLockout: 4 * time.Minute,
+		},
+		{
+			name:        "flags over file",
+			file:        "port: 8091\nlogin_lockout: 2m",
+			args:        []string{"-login-lockout", "5m"},
+			wantPort:    "8091",
+			wantLockout: 5 * time.Minute,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clearEnv(t)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			args := append([]string{"-config", writeConfig(t, requiredYAML+tc.file)}, tc.args...)
+
+			cfg, err := Load(args)
+			if err != nil {
+				t.Fatalf("could not load config: %v", err)
+			}
+			if cfg.Port != tc.wantPort {
+				t.Errorf("expected port %s, got %s", tc.wantPort, cfg.Port)
+			}
+			if cfg.LoginLockout != tc.wantLockout {
+				t.Errorf("expected login lockout %v, got %v", tc.wantLockout, cfg.LoginLockout)
+			}
+			if want := "http://localhost:" + tc.wantPort; cfg.PublicBaseURL != want {
+				t.Errorf("expected public base URL %s, got %s", want, cfg.PublicBaseURL)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("CONFIG_FILE", writeConfig(t, requiredYAML+"port: 8091"))
+
+	cfg, err := Load(nil)
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	if cfg.S3Bucket != "bucket" {
+		t.Errorf("expected settings from CONFIG_FILE, got bucket %q", cfg.S3Bucket)
+	}
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	want := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}
+	tests := []struct {
+		name string
+		file string
+		env  string
+		want []netip.Prefix
+	}{
+		{name: "unset"},
+		{name: "file list", file: "trusted_proxies: [127.0.0.1, 10.0.0.0/8, \"::1\"]", want: want},
+		{name: "env", env: "127.0.0.1, 10.1.2.3/8,::1", want: want},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clearEnv(t)
+			t.Setenv("TRUSTED_PROXIES", tc.env)
+
+			cfg, err := Load([]string{"-config", writeConfig(t, requiredYAML+"port: 8091\n"+tc.file)})
+			if err != nil {
+				t.Fatalf("could not load config: %v", err)
+			}
+			if !slices.Equal(cfg.TrustedProxies, tc.want) {
+				t.Errorf("expected trusted proxies %v, got %v", tc.want, cfg.TrustedProxies)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		clearEnv(t)
+		t.Setenv("TRUSTED_PROXIES", "10.0.0.0/33,proxy.local")
+
+		_, err := Load([]string{"-config", writeConfig(t, requiredYAML+"port: 8091")})
+		if err == nil || !strings.Contains(err.Error(), `TRUSTED_PROXIES: invalid CIDR range "10.0.0.0/33"`) {
+			t.Errorf("expected an invalid range error, got %v", err)
+		}
+	})
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("LOGIN_MAX_FAILURES", "many")
+	path := writeConfig(t, "port: 99999\nunknown_setting: 1\nmail_backend: pigeon")
+
+	_, err := Load([]string{
+		"-config", path,
+		"-login-lockout", "soon",
+		"-max-video-upload-size", "huge",
+		"-log-level", "loud",
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"DB_PATH must be set",
+		"JWT_SECRET must be set",
+		"PORT must be a number between 1 and 65535",
+		`unknown setting "unknown_setting"`,
+		"MAIL_BACKEND must be file or smtp",
+		"LOGIN_MAX_FAILURES: invalid integer",
+		"-login-lockout: invalid duration",
+		"-max-video-upload-size: invalid size",
+		"LOG_LEVEL must be one of",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to contain %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Port = "0"
+	cfg.PublicBaseURL = "localhost:8091"
+	cfg.LoginLockout = time.Hour
+	cfg.LoginLockoutMax = time.Minute
+	cfg.MailBackend = "smtp"
+	cfg.VideoBackend = "tape"
+
+	errs := cfg.validate()
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	got := strings.Join(msgs, "\n")
+	for _, want := range []string{
+		"DB_PATH must be set",
+		"PORT must be a number between 1 and 65535",
+		"PUBLIC_BASE_URL must be an absolute http(s) URL",
+		"LOGIN_LOCKOUT_MAX must not be shorter than LOGIN_LOCKOUT",
+		"SMTP_ADDR must be host:port",
+		"VIDEO_BACKEND must be s3 or local",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected an error containing %q, got:\n%s", want, got)
+		}
+	}
+
+	valid := Default()
+	valid.DBPath, valid.JWTSecret, valid.Platform = "tubely.db", "secret", "dev"
+	valid.FilepathRoot, valid.AssetsRoot, valid.Port = "./app", "./assets", "8091"
+	valid.S3Bucket, valid.S3Region, valid.S3CfDistribution = "bucket", "us-east-2", "cdn.example.com"
+	if errs := valid.validate(); len(errs) != 0 {
+		t.Errorf("expected no errors, got %v", errs)
+	}
+
+	local := valid
+	local.VideoBackend = "local"
+	local.S3Bucket, local.S3Region, local.S3CfDistribution = "", "", ""
+	if errs := local.validate(); len(errs) != 0 {
+		t.Errorf("expected the local backend not to need S3 settings, got %v", errs)
+	}
+	valid.S3CfDistribution = ""
+	errs = valid.validate()
+	if len(errs) != 1 || errs[0].Error() != "S3_CF_DISTRO must be set" {
+		t.Errorf("expected the s3 backend to need S3_CF_DISTRO, got %v", errs)
+	}
+}
+
+func TestByteSizeValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "1024", want: 1024},
+		{in: "10MiB", want: 10 << 20},
+		{in: " 2 GB ", want: 2e9},
+		{in: "8589934591GiB", want: 8589934591 << 30},
+		{in: "8589934592GiB", wantErr: true},
+		{in: "99999999999GiB", wantErr: true},
+		{in: "-99999999999GiB", wantErr: true},
+		{in: "9223372036854775807B", want: 9223372036854775807},
+		{in: "9223372036854775808", wantErr: true},
+		{in: "1.5GiB", wantErr: true},
+		{in: "huge", wantErr: true},
+	}
+	for _, tc := range tests {
+		var v byteSizeValue
+		err := v.Set(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("Set(%q): expected an error, got %d", tc.in, v)
+			}
+			continue
+		}
+		if err != nil || int64(v) != tc.want {
+			t.Errorf("Set(%q) = %d, %v, want %d", tc.in, v, err, tc.want)
+		}
+	}
+}
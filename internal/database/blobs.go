@@ -0,0 +1,113 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// CreateBlobParams describes a stored file shared by every video that
+// uploaded the same content. Its blob row counts the video fields pointing
+// at it, and the file is deleted when that drops to zero.
+type CreateBlobParams struct {
+	StoredObject
+	SHA256 string
+	Size   int64
+}
+
+// AcquireBlob records a new reference to a stored file, creating its blob
+// row on first use. It reports whether the caller must store the file,
+// which is the case until one of the references marks it stored: an
+// earlier upload may still be storing it, or may yet fail to.
+func (c Client) AcquireBlob(ctx context.Context, params CreateBlobParams) (bool, error) {
+	ctx, done := startQuery(ctx, "AcquireBlob")
+	defer done()
+
+	query := `
+	INSERT INTO blobs (
+		backend,
+		bucket,
+		key,
+		sha256,
+		size,
+		ref_count,
+		stored,
+		created_at,
+		updated_at
+	) VALUES (?, ?, ?, ?, ?, 1, FALSE, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	ON CONFLICT (backend, bucket, key) DO UPDATE SET
+		ref_count = ref_count + 1,
+		updated_at = CURRENT_TIMESTAMP
+	RETURNING stored
+	`
+	var stored bool
+	err := c.db.QueryRowContext(ctx,
+		query,
+		params.Backend,
+		params.Bucket,
+		params.Key,
+		params.SHA256,
+		params.Size,
+	).Scan(&stored)
+	if err != nil {
+		return false, err
+	}
+	return !stored, nil
+}
+
+// MarkBlobStored records that the file at obj has been stored, so later
+// references can reuse it.
+func (c Client) MarkBlobStored(ctx context.Context, obj StoredObject) error {
+	ctx, done := startQuery(ctx, "MarkBlobStored")
+	defer done()
+
+	_, err := c.db.ExecContext(ctx, `
+	UPDATE blobs SET stored = TRUE, updated_at = CURRENT_TIMESTAMP
+	WHERE backend = ? AND bucket = ? AND key = ?
+	`, obj.Backend, obj.Bucket, obj.Key)
+	return err
+}
+
+// ReleaseBlob drops a reference to the file stored at obj. It reports
+// whether that was the last reference, in which case the blob row is gone
+// and the caller should delete the file. Files without a blob row, such as
+// uploads that predate deduplication, are never reported as unreferenced.
+func (c Client) ReleaseBlob(ctx context.Context, obj StoredObject) (bool, error) {
+	ctx, done := startQuery(ctx, "ReleaseBlob")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var refCount int
+	err = tx.QueryRowContext(ctx, `
+	UPDATE blobs
+	SET ref_count = ref_count - 1, updated_at = CURRENT_TIMESTAMP
+	WHERE backend = ? AND bucket = ? AND key = ?
+	RETURNING ref_count
+	`, obj.Backend, obj.Bucket, obj.Key).Scan(&refCount)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not release blob: %w", err)
+	}
+
+	if refCount <= 0 {
+		if _, err := tx.ExecContext(ctx, `
+		DELETE FROM blobs
+		WHERE backend = ? AND bucket = ? AND key = ?
+		`, obj.Backend, obj.Bucket, obj.Key); err != nil {
+			return false, fmt.Errorf("could not delete blob: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return refCount <= 0, nil
+}
@@ -1,12 +1,26 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
 	_ "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ErrNotFound is returned by getters when no row matches.
+var ErrNotFound = errors.New("not found")
+
+// ErrConflict is returned by conditional updates when the row was changed
+// since it was read.
+var ErrConflict = errors.New("modified concurrently")
+
 type Client struct {
 	db *sql.DB
 }
@@ -25,6 +39,33 @@ func NewClient(pathToDB string) (Client, error) {
 
 }
 
+var tracer = otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database")
+
+// startQuery opens a trace span for a Client method. The returned func ends
+// the span and records the method's latency, call it deferred at the top of
+// each method that talks to the database.
+func startQuery(ctx context.Context, query string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "database."+query, trace.WithAttributes(
+		attribute.String("db.system", "sqlite"),
+	))
+	return ctx, func() {
+		span.End()
+		metrics.DBQueryDuration.WithLabelValues(query).Observe(metrics.Since(start))
+	}
+}
+
+func (c Client) Ping(ctx context.Context) error {
+	ctx, done := startQuery(ctx, "Ping")
+	defer done()
+
+	return c.db.PingContext(ctx)
+}
+
+func (c Client) Close() error {
+	return c.db.Close()
+}
+
 func (c *Client) autoMigrate() error {
 	userTable := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -72,18 +113,43 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return c.runMigrations()
 }
 
-func (c Client) Reset() error {
-	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
+func (c Client) Reset(ctx context.Context) error {
+	ctx, done := startQuery(ctx, "Reset")
+	defer done()
+
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM playlists_videos"); err != nil {
+		return fmt.Errorf("failed to reset table playlists_videos: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM playlists"); err != nil {
+		return fmt.Errorf("failed to reset table playlists: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM videos_tags"); err != nil {
+		return fmt.Errorf("failed to reset table videos_tags: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM tags"); err != nil {
+		return fmt.Errorf("failed to reset table tags: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table user_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM login_attempts"); err != nil {
+		return fmt.Errorf("failed to reset table login_attempts: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM blobs"); err != nil {
+		return fmt.Errorf("failed to reset table blobs: %w", err)
+	}
 	return nil
 }
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Login attempt outcomes. Only LoginBadPassword counts towards a lockout,
+// so attempts rejected while locked don't extend it. LoginPasswordReset
+// records a completed password reset, which like a successful sign-in ends
+// the run of failures.
+const (
+	LoginSuccess       = "success"
+	LoginBadPassword   = "bad_password"
+	LoginUnknownEmail  = "unknown_email"
+	LoginLocked        = "locked"
+	LoginPasswordReset = "password_reset"
+)
+
+type LoginAttempt struct {
+	ID        int64      `json:"-"`
+	UserID    *uuid.UUID `json:"-"`
+	Email     string     `json:"-"`
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"user_agent"`
+	Result    string     `json:"result"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type CreateLoginAttemptParams struct {
+	// UserID is nil when the email doesn't belong to an account.
+	UserID    *uuid.UUID
+	Email     string
+	IP        string
+	UserAgent string
+	Result    string
+}
+
+func (c Client) CreateLoginAttempt(ctx context.Context, params CreateLoginAttemptParams) error {
+	ctx, done := startQuery(ctx, "CreateLoginAttempt")
+	defer done()
+
+	query := `
+	INSERT INTO login_attempts (
+		user_id,
+		email,
+		ip,
+		user_agent,
+		result,
+		created_at
+	) VALUES (?, ?, ?, ?, ?, ?)
+	`
+	var userID any
+	if params.UserID != nil {
+		userID = params.UserID.String()
+	}
+	_, err := c.db.ExecContext(ctx,
+		query,
+		userID,
+		params.Email,
+		params.IP,
+		params.UserAgent,
+		params.Result,
+		time.Now().UTC(),
+	)
+	return err
+}
+
+// GetLoginAttempts returns the user's most recent login attempts, newest
+// first.
+func (c Client) GetLoginAttempts(ctx context.Context, userID uuid.UUID, limit int) ([]LoginAttempt, error) {
+	ctx, done := startQuery(ctx, "GetLoginAttempts")
+	defer done()
+
+	query := `
+	SELECT id, user_id, email, ip, user_agent, result, created_at
+	FROM login_attempts
+	WHERE user_id = ?
+	ORDER BY created_at DESC, id DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.QueryContext(ctx, query, userID.String(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var attempt LoginAttempt
+		if err := rows.Scan(
+			&attempt.ID,
+			&attempt.UserID,
+			&attempt.Email,
+			&attempt.IP,
+			&attempt.UserAgent,
+			&attempt.Result,
+			&attempt.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+
+	return attempts, rows.Err()
+}
+
+// LoginFailures summarises the failed password attempts since a user last
+// signed in successfully or reset their password.
+type LoginFailures struct {
+	Count int
+	Last  time.Time
+}
+
+func (c Client) GetLoginFailures(ctx context.Context, userID uuid.UUID) (LoginFailures, error) {
+	ctx, done := startQuery(ctx, "GetLoginFailures")
+	defer done()
+
+	query := `
+	SELECT COUNT(*) OVER (), created_at
+	FROM login_attempts
+	WHERE user_id = ?
+		AND result = ?
+		AND id > COALESCE((
+			SELECT MAX(id) FROM login_attempts WHERE user_id = ? AND result IN (?, ?)
+		), 0)
+	ORDER BY id DESC
+	LIMIT 1
+	`
+
+	var failures LoginFailures
+	err := c.db.QueryRowContext(ctx, query,
+		userID.String(), LoginBadPassword,
+		userID.String(), LoginSuccess, LoginPasswordReset,
+	).Scan(&failures.Count, &failures.Last)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LoginFailures{}, nil
+		}
+		return LoginFailures{}, err
+	}
+	return failures, nil
+}
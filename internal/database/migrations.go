@@ -0,0 +1,401 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// migration is a one-time schema or data change applied after the base
+// tables exist. Migrations run in order and each is recorded in
+// schema_migrations so it is never applied twice. Never edit or reorder a
+// migration that has shipped, append a new one instead.
+type migration struct {
+	name string
+	up   func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		name: "add_videos_thumbnail_key",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`ALTER TABLE videos ADD COLUMN thumbnail_key TEXT`)
+			return err
+		},
+	},
+	{
+		// Thumbnails used to be stored as absolute localhost URLs, which
+		// break as soon as the server is reached through any other origin.
+		name: "thumbnail_urls_to_keys",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			UPDATE videos
+			SET
+				thumbnail_key = substr(thumbnail_url, instr(thumbnail_url, '/assets/') + length('/assets/')),
+				thumbnail_url = NULL
+			WHERE thumbnail_url LIKE 'http://localhost:%/assets/%'
+			`)
+			return err
+		},
+	},
+	{
+		name: "add_videos_storage_columns",
+		up: func(tx *sql.Tx) error {
+			for _, column := range []string{
+				"thumbnail_backend",
+				"thumbnail_bucket",
+				"video_backend",
+				"video_bucket",
+				"video_key",
+			} {
+				if _, err := tx.Exec(`ALTER TABLE videos ADD COLUMN ` + column + ` TEXT`); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(`UPDATE videos SET thumbnail_backend = ? WHERE thumbnail_key IS NOT NULL`, BackendLocal)
+			return err
+		},
+	},
+	{
+		// Videos used to be stored as CloudFront URLs, tying every row to
+		// the distribution in use at upload time.
+		name: "video_urls_to_keys",
+		up:   migrateVideoURLsToKeys,
+	},
+	{
+		name: "add_videos_visibility",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`ALTER TABLE videos ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public'`)
+			return err
+		},
+	},
+	{
+		// Uploads are stored under keys derived from their SHA-256 and
+		// shared between videos. Older uploads have random keys and no
+		// blob row, so they are left alone when released.
+		name: "create_blobs",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE blobs (
+				backend TEXT NOT NULL,
+				bucket TEXT NOT NULL DEFAULT '',
+				key TEXT NOT NULL,
+				sha256 TEXT NOT NULL,
+				size INTEGER NOT NULL,
+				ref_count INTEGER NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (backend, bucket, key)
+			)
+			`)
+			return err
+		},
+	},
+	{
+		name: "add_videos_checksums",
+		up: func(tx *sql.Tx) error {
+			for _, column := range []string{"thumbnail_sha256", "video_sha256"} {
+				if _, err := tx.Exec(`ALTER TABLE videos ADD COLUMN ` + column + ` TEXT`); err != nil {
+					return err
+				}
+			}
+			// Content-addressed uploads already have their digest in blobs.
+			_, err := tx.Exec(`
+			UPDATE videos
+			SET
+				thumbnail_sha256 = (
+					SELECT sha256 FROM blobs
+					WHERE backend = thumbnail_backend AND bucket = COALESCE(thumbnail_bucket, '') AND key = thumbnail_key
+				),
+				video_sha256 = (
+					SELECT sha256 FROM blobs
+					WHERE backend = video_backend AND bucket = COALESCE(video_bucket, '') AND key = video_key
+				)
+			`)
+			return err
+		},
+	},
+	{
+		name: "create_login_attempts",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE login_attempts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id TEXT,
+				email TEXT NOT NULL,
+				ip TEXT NOT NULL,
+				user_agent TEXT NOT NULL,
+				result TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			);
+			CREATE INDEX login_attempts_user_id ON login_attempts (user_id, id);
+			`)
+			return err
+		},
+	},
+	{
+		name: "add_email_verification_and_user_tokens",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP;
+			CREATE TABLE user_tokens (
+				token_hash TEXT PRIMARY KEY,
+				user_id TEXT NOT NULL,
+				purpose TEXT NOT NULL,
+				email TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				used_at TIMESTAMP,
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			);
+			CREATE INDEX user_tokens_user_id ON user_tokens (user_id, purpose);
+			`)
+			return err
+		},
+	},
+	{
+		name: "create_tags",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE tags (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL UNIQUE
+			);
+			CREATE TABLE videos_tags (
+				video_id TEXT NOT NULL,
+				tag_id INTEGER NOT NULL,
+				PRIMARY KEY (video_id, tag_id),
+				FOREIGN KEY(video_id) REFERENCES videos(id),
+				FOREIGN KEY(tag_id) REFERENCES tags(id)
+			);
+			CREATE INDEX videos_tags_tag_id ON videos_tags (tag_id);
+			`)
+			return err
+		},
+	},
+	{
+		name: "create_playlists",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE playlists (
+				id TEXT PRIMARY KEY,
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				title TEXT NOT NULL,
+				description TEXT NOT NULL,
+				user_id TEXT NOT NULL,
+				visibility TEXT NOT NULL DEFAULT 'public',
+				FOREIGN KEY(user_id) REFERENCES users(id)
+			);
+			CREATE INDEX playlists_user_id ON playlists (user_id);
+			CREATE TABLE playlists_videos (
+				playlist_id TEXT NOT NULL,
+				video_id TEXT NOT NULL,
+				position INTEGER NOT NULL,
+				added_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (playlist_id, video_id),
+				FOREIGN KEY(playlist_id) REFERENCES playlists(id),
+				FOREIGN KEY(video_id) REFERENCES videos(id)
+			);
+			CREATE INDEX playlists_videos_video_id ON playlists_videos (video_id);
+			`)
+			return err
+		},
+	},
+	{
+		// thumbnail_urls_to_keys only matched http://localhost:<port>,
+		// missing thumbnails saved through 127.0.0.1, https or the default
+		// port. URLs on other hosts may not point at this server and keep
+		// being served as they are.
+		name: "loopback_thumbnail_urls_to_keys",
+		up:   migrateLoopbackThumbnailURLs,
+	},
+	{
+		// A blob row is now created before its file is stored. Rows that
+		// already exist are assumed to have been stored.
+		name: "add_blobs_stored",
+		up: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`ALTER TABLE blobs ADD COLUMN stored BOOLEAN NOT NULL DEFAULT TRUE`)
+			return err
+		},
+	},
+}
+
+func migrateLoopbackThumbnailURLs(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, thumbnail_url FROM videos WHERE thumbnail_url IS NOT NULL AND thumbnail_key IS NULL`)
+	if err != nil {
+		return err
+	}
+	type legacyURL struct {
+		id  string
+		url string
+	}
+	var legacy []legacyURL
+	for rows.Next() {
+		var l legacyURL
+		if err := rows.Scan(&l.id, &l.url); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, l := range legacy {
+		key, ok := parseLocalAssetURL(l.url)
+		if !ok {
+			continue
+		}
+		_, err := tx.Exec(`
+		UPDATE videos
+		SET thumbnail_backend = ?, thumbnail_key = ?, thumbnail_url = NULL
+		WHERE id = ?
+		`, BackendLocal, key, l.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLocalAssetURL returns the asset key of a URL this server generated
+// for a locally stored file, which always used a loopback host.
+func parseLocalAssetURL(raw string) (string, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+	default:
+		return "", false
+	}
+	key, ok := strings.CutPrefix(u.Path, "/assets/")
+	if !ok || key == "" {
+		return "", false
+	}
+	return key, true
+}
+
+func migrateVideoURLsToKeys(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, video_url FROM videos WHERE video_url IS NOT NULL AND video_key IS NULL`)
+	if err != nil {
+		return err
+	}
+	type legacyURL struct {
+		id  string
+		url string
+	}
+	var legacy []legacyURL
+	for rows.Next() {
+		var l legacyURL
+		if err := rows.Scan(&l.id, &l.url); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, l := range legacy {
+		obj, ok := parseS3URL(l.url)
+		if !ok {
+			continue
+		}
+		_, err := tx.Exec(`
+		UPDATE videos
+		SET video_backend = ?, video_bucket = ?, video_key = ?, video_url = NULL
+		WHERE id = ?
+		`, obj.Backend, sql.NullString{String: obj.Bucket, Valid: obj.Bucket != ""}, obj.Key, l.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseS3URL recovers the object location from a URL previously stored for
+// a video. CloudFront URLs don't name their bucket, so they map to the
+// configured bucket. Virtual-hosted and path style S3 URLs keep theirs.
+func parseS3URL(raw string) (StoredObject, bool) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return StoredObject{}, false
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	if path == "" {
+		return StoredObject{}, false
+	}
+
+	obj := StoredObject{Backend: BackendS3, Key: path}
+	host := u.Hostname()
+	switch {
+	case strings.HasSuffix(host, ".cloudfront.net") || !strings.HasSuffix(host, ".amazonaws.com"):
+		// CloudFront or a custom CDN domain in front of the bucket
+	case strings.HasPrefix(host, "s3.") || strings.HasPrefix(host, "s3-"):
+		bucket, key, found := strings.Cut(path, "/")
+		if !found || key == "" {
+			return StoredObject{}, false
+		}
+		obj.Bucket = bucket
+		obj.Key = key
+	default:
+		// The bucket may itself contain ".s3", the endpoint starts at the
+		// last ".s3." or ".s3-".
+		end := max(strings.LastIndex(host, ".s3."), strings.LastIndex(host, ".s3-"))
+		if end <= 0 {
+			return StoredObject{}, false
+		}
+		obj.Bucket = host[:end]
+	}
+	return obj, true
+}
+
+func (c *Client) runMigrations() error {
+	_, err := c.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := c.applyMigration(m); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) applyMigration(m migration) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE name = ?)`, m.name).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	if err := m.up(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (name) VALUES (?)`, m.name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
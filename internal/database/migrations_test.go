@@ -0,0 +1,224 @@
+package database
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// newClientBefore returns a client whose database has every migration
+// before the named one applied, so tests can seed legacy rows and then run
+// the rest with runMigrations.
+func newClientBefore(t *testing.T, name string) Client {
+	t.Helper()
+	i := slices.IndexFunc(migrations, func(m migration) bool { return m.name == name })
+	if i < 0 {
+		t.Fatalf("unknown migration %q", name)
+	}
+
+	all := migrations
+	migrations = all[:i]
+	c, err := NewClient(filepath.Join(t.TempDir(), "test.db"))
+	migrations = all
+	if err != nil {
+		t.Fatalf("could not create database: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestThumbnailURLMigrations(t *testing.T) {
+	c := newClientBefore(t, "thumbnail_urls_to_keys")
+
+	tests := []struct {
+		name    string
+		url     sql.NullString
+		wantKey sql.NullString
+	}{
+		{name: "localhost with port", url: valid("http://localhost:8091/assets/abc.png"), wantKey: valid("abc.png")},
+		{name: "localhost default port", url: valid("http://localhost/assets/def.png"), wantKey: valid("def.png")},
+		{name: "https localhost", url: valid("https://localhost:8443/assets/ghi.jpeg"), wantKey: valid("ghi.jpeg")},
+		{name: "IPv4 loopback", url: valid("http://127.0.0.1:8091/assets/jkl.png"), wantKey: valid("jkl.png")},
+		{name: "IPv6 loopback", url: valid("http://[::1]:8091/assets/mno.png"), wantKey: valid("mno.png")},
+		{name: "custom host", url: valid("https://cdn.example.com/assets/pqr.png")},
+		{name: "not an asset", url: valid("http://localhost:8091/app/index.html")},
+		{name: "no key", url: valid("http://127.0.0.1:8091/assets/")},
+		{name: "unparseable", url: valid("http://127.0.0.1:port/assets/stu.png")},
+		{name: "no thumbnail"},
+	}
+	ids := make([]uuid.UUID, len(tests))
+	for i, tc := range tests {
+		ids[i] = uuid.New()
+		_, err := c.db.Exec(`INSERT INTO videos (id, title, thumbnail_url) VALUES (?, ?, ?)`, ids[i], tc.name, tc.url)
+		if err != nil {
+			t.Fatalf("could not seed video: %v", err)
+		}
+	}
+
+	if err := c.runMigrations(); err != nil {
+		t.Fatalf("could not run migrations: %v", err)
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var url, backend, key sql.NullString
+			err := c.db.QueryRow(`SELECT thumbnail_url, thumbnail_backend, thumbnail_key FROM videos WHERE id = ?`, ids[i]).Scan(&url, &backend, &key)
+			if err != nil {
+				t.Fatalf("could not read video: %v", err)
+			}
+			if !tc.wantKey.Valid {
+				if url != tc.url || key.Valid || backend.Valid {
+					t.Errorf("expected %v to be left alone, got url %v, backend %v, key %v", tc.url, url, backend, key)
+				}
+				return
+			}
+			if url.Valid || key != tc.wantKey || backend.String != BackendLocal {
+				t.Errorf("expected local key %v, got url %v, backend %v, key %v", tc.wantKey, url, backend, key)
+			}
+		})
+	}
+}
+
+func valid(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: true}
+}
+
+func TestParseS3URL(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		want   StoredObject
+		wantOK bool
+	}{
+		{
+			name:   "CloudFront",
+			url:    "https://d111111abcdef8.cloudfront.net/landscape/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Key: "landscape/abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name:   "custom CDN host",
+			url:    "https://cdn.example.com/portrait/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Key: "portrait/abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name:   "path style",
+			url:    "https://s3.us-east-2.amazonaws.com/tubely-bucket/landscape/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Bucket: "tubely-bucket", Key: "landscape/abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name:   "legacy path style",
+			url:    "https://s3-us-west-2.amazonaws.com/tubely-bucket/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Bucket: "tubely-bucket", Key: "abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name: "path style without key",
+			url:  "https://s3.us-east-2.amazonaws.com/tubely-bucket",
+		},
+		{
+			name: "path style with empty key",
+			url:  "https://s3.amazonaws.com/tubely-bucket/",
+		},
+		{
+			name:   "virtual hosted global endpoint",
+			url:    "https://tubely-bucket.s3.amazonaws.com/landscape/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Bucket: "tubely-bucket", Key: "landscape/abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name:   "virtual hosted with region",
+			url:    "https://tubely-bucket.s3.us-east-2.amazonaws.com/landscape/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Bucket: "tubely-bucket", Key: "landscape/abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name:   "virtual hosted with legacy region",
+			url:    "https://tubely-bucket.s3-us-west-2.amazonaws.com/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Bucket: "tubely-bucket", Key: "abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name:   "virtual hosted bucket containing s3",
+			url:    "https://media.s3bucket.s3.eu-west-1.amazonaws.com/abc.mp4",
+			want:   StoredObject{Backend: BackendS3, Bucket: "media.s3bucket", Key: "abc.mp4"},
+			wantOK: true,
+		},
+		{
+			name: "amazonaws host without bucket",
+			url:  "https://ec2.us-east-2.amazonaws.com/abc.mp4",
+		},
+		{
+			name: "no path",
+			url:  "https://d111111abcdef8.cloudfront.net/",
+		},
+		{
+			name: "no host",
+			url:  "landscape/abc.mp4",
+		},
+		{
+			name: "unparseable",
+			url:  "https://cdn.example.com:port/abc.mp4",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseS3URL(tc.url)
+			if ok != tc.wantOK || got != tc.want {
+				t.Errorf("parseS3URL(%q) = %+v, %v, want %+v, %v", tc.url, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestVideoURLMigration(t *testing.T) {
+	c := newClientBefore(t, "video_urls_to_keys")
+
+	tests := []struct {
+		name       string
+		url        string
+		wantBucket sql.NullString
+		wantKey    sql.NullString
+	}{
+		{name: "CloudFront", url: "https://d111111abcdef8.cloudfront.net/landscape/abc.mp4", wantKey: valid("landscape/abc.mp4")},
+		{name: "virtual hosted", url: "https://tubely-bucket.s3.us-east-2.amazonaws.com/abc.mp4", wantBucket: valid("tubely-bucket"), wantKey: valid("abc.mp4")},
+		{name: "unparseable", url: "https://cdn.example.com:port/abc.mp4"},
+		{name: "path style without key", url: "https://s3.us-east-2.amazonaws.com/tubely-bucket"},
+	}
+	ids := make([]uuid.UUID, len(tests))
+	for i, tc := range tests {
+		ids[i] = uuid.New()
+		_, err := c.db.Exec(`INSERT INTO videos (id, title, video_url) VALUES (?, ?, ?)`, ids[i], tc.name, tc.url)
+		if err != nil {
+			t.Fatalf("could not seed video: %v", err)
+		}
+	}
+
+	if err := c.runMigrations(); err != nil {
+		t.Fatalf("could not run migrations: %v", err)
+	}
+
+	for i, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var url, backend, bucket, key sql.NullString
+			err := c.db.QueryRow(`SELECT video_url, video_backend, video_bucket, video_key FROM videos WHERE id = ?`, ids[i]).Scan(&url, &backend, &bucket, &key)
+			if err != nil {
+				t.Fatalf("could not read video: %v", err)
+			}
+			if !tc.wantKey.Valid {
+				if url.String != tc.url || backend.Valid || key.Valid {
+					t.Errorf("expected %s to keep its URL, got url %v, backend %v, key %v", tc.url, url, backend, key)
+				}
+				return
+			}
+			if url.Valid || backend.String != BackendS3 || bucket != tc.wantBucket || key != tc.wantKey {
+				t.Errorf("expected bucket %v and key %v, got url %v, backend %v, bucket %v, key %v", tc.wantBucket, tc.wantKey, url, backend, bucket, key)
+			}
+		})
+	}
+}
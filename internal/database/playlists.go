@@ -0,0 +1,465 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Playlist is an ordered list of videos. Its visibility is independent of
+// the videos in it: a public playlist may hold private videos, which are
+// only shown to their owners.
+type Playlist struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// VideoCount counts every entry, including videos the viewer can't see.
+	VideoCount int `json:"video_count"`
+	CreatePlaylistParams
+}
+
+type CreatePlaylistParams struct {
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	UserID      uuid.UUID `json:"user_id"`
+	// Visibility is VisibilityPublic or VisibilityPrivate. Defaults to
+	// public.
+	Visibility string `json:"visibility"`
+}
+
+const playlistColumns = `
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		user_id,
+		visibility,
+		(SELECT COUNT(*) FROM playlists_videos pv WHERE pv.playlist_id = playlists.id)`
+
+func scanPlaylist(row rowScanner) (Playlist, error) {
+	var playlist Playlist
+	err := row.Scan(
+		&playlist.ID,
+		&playlist.CreatedAt,
+		&playlist.UpdatedAt,
+		&playlist.Title,
+		&playlist.Description,
+		&playlist.UserID,
+		&playlist.Visibility,
+		&playlist.VideoCount,
+	)
+	return playlist, err
+}
+
+func (c Client) CreatePlaylist(ctx context.Context, params CreatePlaylistParams) (Playlist, error) {
+	ctx, done := startQuery(ctx, "CreatePlaylist")
+	defer done()
+
+	id := uuid.New()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	query := `
+	INSERT INTO playlists (
+		id,
+		created_at,
+		updated_at,
+		title,
+		description,
+		user_id,
+		visibility
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	_, err := c.db.ExecContext(ctx, query, id, now, now, params.Title, params.Description, params.UserID, visibility)
+	if err != nil {
+		return Playlist{}, err
+	}
+
+	return c.GetPlaylist(ctx, id)
+}
+
+func (c Client) GetPlaylist(ctx context.Context, id uuid.UUID) (Playlist, error) {
+	ctx, done := startQuery(ctx, "GetPlaylist")
+	defer done()
+
+	query := `
+	SELECT` + playlistColumns + `
+	FROM playlists
+	WHERE id = ?
+	`
+
+	playlist, err := scanPlaylist(c.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Playlist{}, ErrNotFound
+		}
+		return Playlist{}, err
+	}
+
+	return playlist, nil
+}
+
+// GetPlaylists returns the user's playlists, most recently updated first.
+func (c Client) GetPlaylists(ctx context.Context, userID uuid.UUID) ([]Playlist, error) {
+	ctx, done := startQuery(ctx, "GetPlaylists")
+	defer done()
+
+	query := `
+	SELECT` + playlistColumns + `
+	FROM playlists
+	WHERE user_id = ?
+	ORDER BY updated_at DESC
+	`
+	rows, err := c.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	playlists := []Playlist{}
+	for rows.Next() {
+		playlist, err := scanPlaylist(rows)
+		if err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, playlist)
+	}
+	return playlists, rows.Err()
+}
+
+// UpdatePlaylist saves the playlist's title, description and visibility and
+// sets its UpdatedAt to the current time.
+func (c Client) UpdatePlaylist(ctx context.Context, playlist *Playlist) error {
+	ctx, done := startQuery(ctx, "UpdatePlaylist")
+	defer done()
+
+	query := `
+	UPDATE playlists
+	SET
+		title = ?,
+		description = ?,
+		visibility = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	now := nextUpdatedAt(playlist.UpdatedAt)
+	res, err := c.db.ExecContext(ctx, query, playlist.Title, playlist.Description, playlist.Visibility, now, playlist.ID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	playlist.UpdatedAt = now
+	return nil
+}
+
+func (c Client) DeletePlaylist(ctx context.Context, id uuid.UUID) error {
+	ctx, done := startQuery(ctx, "DeletePlaylist")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM playlists_videos WHERE playlist_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM playlists WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPlaylistVideos returns the videos in the playlist in order.
+func (c Client) GetPlaylistVideos(ctx context.Context, playlistID uuid.UUID) ([]Video, error) {
+	ctx, done := startQuery(ctx, "GetPlaylistVideos")
+	defer done()
+
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	JOIN playlists_videos pv ON pv.video_id = videos.id
+	WHERE pv.playlist_id = ?
+	ORDER BY pv.position
+	`
+	rows, err := c.db.QueryContext(ctx, query, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+// AddPlaylistVideo inserts the video at position, counted from zero, or at
+// the end if position is past it. It returns ErrConflict if the video is
+// already in the playlist.
+func (c Client) AddPlaylistVideo(ctx context.Context, playlist *Playlist, videoID uuid.UUID, position int) error {
+	ctx, done := startQuery(ctx, "AddPlaylistVideo")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertPlaylistEntry(ctx, tx, playlist.ID, videoID, position); err != nil {
+		return err
+	}
+	if err := touchPlaylist(ctx, tx, playlist); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemovePlaylistVideo removes the video from the playlist, or returns
+// ErrNotFound if it isn't in it.
+func (c Client) RemovePlaylistVideo(ctx context.Context, playlist *Playlist, videoID uuid.UUID) error {
+	ctx, done := startQuery(ctx, "RemovePlaylistVideo")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := removePlaylistEntry(ctx, tx, playlist.ID, videoID); err != nil {
+		return err
+	}
+	if err := touchPlaylist(ctx, tx, playlist); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MovePlaylistVideo moves the video to position in the to playlist, which
+// may be the playlist it is in. It returns ErrNotFound if the video isn't
+// in from, and ErrConflict if it is already in a different to.
+func (c Client) MovePlaylistVideo(ctx context.Context, from *Playlist, videoID uuid.UUID, to *Playlist, position int) error {
+	ctx, done := startQuery(ctx, "MovePlaylistVideo")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := removePlaylistEntry(ctx, tx, from.ID, videoID); err != nil {
+		return err
+	}
+	if err := insertPlaylistEntry(ctx, tx, to.ID, videoID, position); err != nil {
+		return err
+	}
+	if err := touchPlaylist(ctx, tx, from); err != nil {
+		return err
+	}
+	if to.ID != from.ID {
+		if err := touchPlaylist(ctx, tx, to); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if to.ID == from.ID {
+		to.UpdatedAt = from.UpdatedAt
+		to.VideoCount = from.VideoCount
+	}
+	return nil
+}
+
+// ReorderPlaylist puts the playlist's videos in the order of videoIDs,
+// which must list each of them exactly once. Otherwise, for example if a
+// video was added concurrently, it returns ErrConflict.
+func (c Client) ReorderPlaylist(ctx context.Context, playlist *Playlist, videoIDs []uuid.UUID) error {
+	ctx, done := startQuery(ctx, "ReorderPlaylist")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM playlists_videos WHERE playlist_id = ?`, playlist.ID).Scan(&count); err != nil {
+		return err
+	}
+	if count != len(videoIDs) {
+		return ErrConflict
+	}
+	for i, videoID := range videoIDs {
+		// Positions are first moved out of the way so duplicated IDs
+		// leave an entry unchanged and are caught below.
+		res, err := tx.ExecContext(ctx, `
+		UPDATE playlists_videos SET position = ?
+		WHERE playlist_id = ? AND video_id = ? AND position >= 0
+		`, -1-i, playlist.ID, videoID)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrConflict
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE playlists_videos SET position = -1 - position WHERE playlist_id = ?`, playlist.ID); err != nil {
+		return err
+	}
+	if err := touchPlaylist(ctx, tx, playlist); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertPlaylistEntry shifts the entries at and after position down to make
+// room for the video. Positions stay contiguous from zero.
+func insertPlaylistEntry(ctx context.Context, tx *sql.Tx, playlistID, videoID uuid.UUID, position int) error {
+	var count int
+	var exists bool
+	err := tx.QueryRowContext(ctx, `
+	SELECT COUNT(*), COALESCE(SUM(video_id = ?), 0) > 0
+	FROM playlists_videos
+	WHERE playlist_id = ?
+	`, videoID, playlistID).Scan(&count, &exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrConflict
+	}
+	if position < 0 || position > count {
+		position = count
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE playlists_videos SET position = position + 1
+	WHERE playlist_id = ? AND position >= ?
+	`, playlistID, position)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO playlists_videos (playlist_id, video_id, position, added_at)
+	VALUES (?, ?, ?, ?)
+	`, playlistID, videoID, position, time.Now().UTC())
+	return err
+}
+
+// removePlaylistEntry deletes the video's entry and closes the gap it
+// leaves.
+func removePlaylistEntry(ctx context.Context, tx *sql.Tx, playlistID, videoID uuid.UUID) error {
+	var position int
+	err := tx.QueryRowContext(ctx, `
+	DELETE FROM playlists_videos
+	WHERE playlist_id = ? AND video_id = ?
+	RETURNING position
+	`, playlistID, videoID).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE playlists_videos SET position = position - 1
+	WHERE playlist_id = ? AND position > ?
+	`, playlistID, position)
+	return err
+}
+
+// deletePlaylistEntries removes the videos selected by the videoIDs query
+// from every playlist, keeping the remaining positions contiguous.
+func deletePlaylistEntries(ctx context.Context, tx *sql.Tx, videoIDs string, args ...any) error {
+	rows, err := tx.QueryContext(ctx, `
+	DELETE FROM playlists_videos WHERE video_id IN (`+videoIDs+`)
+	RETURNING playlist_id
+	`, args...)
+	if err != nil {
+		return err
+	}
+	var playlistIDs []any
+	seen := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		if !seen[id] {
+			seen[id] = true
+			playlistIDs = append(playlistIDs, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(playlistIDs) == 0 {
+		return nil
+	}
+
+	// The new positions are computed from a snapshot of the survivors, so
+	// rows already renumbered don't affect the others.
+	_, err = tx.ExecContext(ctx, `
+	UPDATE playlists_videos SET position = renumbered.position
+	FROM (
+		SELECT rowid, ROW_NUMBER() OVER (PARTITION BY playlist_id ORDER BY position) - 1 AS position
+		FROM playlists_videos
+		WHERE playlist_id IN (?`+strings.Repeat(", ?", len(playlistIDs)-1)+`)
+	) AS renumbered
+	WHERE playlists_videos.rowid = renumbered.rowid
+		AND playlists_videos.position != renumbered.position
+	`, playlistIDs...)
+	return err
+}
+
+// touchPlaylist bumps the playlist's updated_at and refreshes its
+// UpdatedAt and VideoCount after its entries changed.
+func touchPlaylist(ctx context.Context, tx *sql.Tx, playlist *Playlist) error {
+	updatedAt := nextUpdatedAt(playlist.UpdatedAt)
+	res, err := tx.ExecContext(ctx, `UPDATE playlists SET updated_at = ? WHERE id = ?`, updatedAt, playlist.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM playlists_videos WHERE playlist_id = ?`, playlist.ID).Scan(&count); err != nil {
+		return err
+	}
+	playlist.UpdatedAt = updatedAt
+	playlist.VideoCount = count
+	return nil
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TagCount is a tag with the number of videos carrying it.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// SetVideoTags replaces the video's tags, which must already be
+// normalized, and sets its Tags and UpdatedAt to match.
+func (c Client) SetVideoTags(ctx context.Context, video *Video, tags []string) error {
+	ctx, done := startQuery(ctx, "SetVideoTags")
+	defer done()
+
+	tags = slices.Compact(slices.Sorted(slices.Values(tags)))
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM videos_tags WHERE video_id = ?`, video.ID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO tags (name) VALUES (?) ON CONFLICT (name) DO NOTHING`, tag); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+		INSERT INTO videos_tags (video_id, tag_id)
+		SELECT ?, id FROM tags WHERE name = ?
+		`, video.ID, tag)
+		if err != nil {
+			return err
+		}
+	}
+	if err := deleteUnusedTags(ctx, tx); err != nil {
+		return err
+	}
+	updatedAt, err := touchVideo(ctx, tx, video)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	video.Tags = tags
+	video.UpdatedAt = updatedAt
+	return nil
+}
+
+// RemoveVideoTag removes tag from the video. It returns false, and leaves
+// the video unchanged, if the video didn't have the tag.
+func (c Client) RemoveVideoTag(ctx context.Context, video *Video, tag string) (bool, error) {
+	ctx, done := startQuery(ctx, "RemoveVideoTag")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+	DELETE FROM videos_tags
+	WHERE video_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)
+	`, video.ID, tag)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := deleteUnusedTags(ctx, tx); err != nil {
+		return false, err
+	}
+	updatedAt, err := touchVideo(ctx, tx, video)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	video.Tags = slices.DeleteFunc(video.Tags, func(t string) bool { return t == tag })
+	video.UpdatedAt = updatedAt
+	return true, nil
+}
+
+// GetUserTags returns the tags on the user's videos with how many videos
+// carry each, most used first.
+func (c Client) GetUserTags(ctx context.Context, userID uuid.UUID) ([]TagCount, error) {
+	ctx, done := startQuery(ctx, "GetUserTags")
+	defer done()
+
+	query := `
+	SELECT t.name, COUNT(*)
+	FROM tags t
+	JOIN videos_tags vt ON vt.tag_id = t.id
+	JOIN videos v ON v.id = vt.video_id
+	WHERE v.user_id = ?
+	GROUP BY t.name
+	ORDER BY COUNT(*) DESC, t.name
+	`
+	rows, err := c.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// touchVideo bumps the video's updated_at, since its tags are part of it,
+// and returns the new value.
+func touchVideo(ctx context.Context, tx *sql.Tx, video *Video) (time.Time, error) {
+	updatedAt := nextUpdatedAt(video.UpdatedAt)
+	res, err := tx.ExecContext(ctx, `UPDATE videos SET updated_at = ? WHERE id = ?`, updatedAt, video.ID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if n == 0 {
+		return time.Time{}, ErrNotFound
+	}
+	return updatedAt, nil
+}
+
+// deleteUnusedTags removes tags no video carries any more.
+func deleteUnusedTags(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM videos_tags)`)
+	return err
+}
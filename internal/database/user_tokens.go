@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Purposes of single-use user tokens.
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposePasswordReset = "password_reset"
+)
+
+// UserToken is a single-use token mailed to a user. Only a hash of the
+// token is stored, so a leaked database can't be used to take over
+// accounts.
+type UserToken struct {
+	TokenHash string
+	UserID    uuid.UUID
+	Purpose   string
+	// Email is the address the token was sent to.
+	Email     string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type CreateUserTokenParams struct {
+	TokenHash string
+	UserID    uuid.UUID
+	Purpose   string
+	Email     string
+	ExpiresAt time.Time
+}
+
+func (c Client) CreateUserToken(ctx context.Context, params CreateUserTokenParams) error {
+	ctx, done := startQuery(ctx, "CreateUserToken")
+	defer done()
+
+	query := `
+	INSERT INTO user_tokens (
+		token_hash,
+		user_id,
+		purpose,
+		email,
+		created_at,
+		expires_at
+	) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.ExecContext(ctx,
+		query,
+		params.TokenHash,
+		params.UserID.String(),
+		params.Purpose,
+		params.Email,
+		params.ExpiresAt.UTC(),
+	)
+	return err
+}
+
+// ConsumeUserToken marks the token as used and returns it. ErrNotFound is
+// returned if the token doesn't exist, has a different purpose, has
+// expired or was already used.
+func (c Client) ConsumeUserToken(ctx context.Context, tokenHash, purpose string) (UserToken, error) {
+	ctx, done := startQuery(ctx, "ConsumeUserToken")
+	defer done()
+
+	now := time.Now().UTC()
+	query := `
+	UPDATE user_tokens
+	SET used_at = ?
+	WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+	RETURNING token_hash, user_id, purpose, email, created_at, expires_at, used_at
+	`
+
+	var token UserToken
+	var userID string
+	err := c.db.QueryRowContext(ctx, query, now, tokenHash, purpose, now).Scan(
+		&token.TokenHash,
+		&userID,
+		&token.Purpose,
+		&token.Email,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.UsedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserToken{}, ErrNotFound
+		}
+		return UserToken{}, err
+	}
+	token.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return UserToken{}, err
+	}
+	return token, nil
+}
+
+// DeleteUserTokens removes the user's tokens for purpose, so that links
+// mailed earlier stop working.
+func (c Client) DeleteUserTokens(ctx context.Context, userID uuid.UUID, purpose string) error {
+	ctx, done := startQuery(ctx, "DeleteUserTokens")
+	defer done()
+
+	query := `
+	DELETE FROM user_tokens
+	WHERE user_id = ? AND purpose = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, userID.String(), purpose)
+	return err
+}
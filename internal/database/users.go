@@ -1,8 +1,10 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,6 +14,9 @@ type User struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// EmailVerifiedAt is when the current email address was confirmed, nil
+	// until then.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 	CreateUserParams
 }
 
@@ -20,7 +25,32 @@ type CreateUserParams struct {
 	Password string `json:"-"`
 }
 
-func (c Client) GetUsers() ([]User, error) {
+const userColumns = `
+		u.id,
+		u.created_at,
+		u.updated_at,
+		u.email,
+		u.password,
+		u.email_verified_at`
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var id string
+	err := row.Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.EmailVerifiedAt)
+	if err != nil {
+		return User{}, err
+	}
+	user.ID, err = uuid.Parse(id)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (c Client) GetUsers(ctx context.Context) ([]User, error) {
+	ctx, done := startQuery(ctx, "GetUsers")
+	defer done()
+
 	query := `
 		SELECT
 			id,
@@ -28,7 +58,7 @@ func (c Client) GetUsers() ([]User, error) {
 		FROM users
 	`
 
-	rows, err := c.db.Query(query)
+	rows, err := c.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -51,54 +81,51 @@ func (c Client) GetUsers() ([]User, error) {
 	return users, nil
 }
 
-func (c Client) GetUserByEmail(email string) (User, error) {
+func (c Client) GetUserByEmail(ctx context.Context, email string) (User, error) {
+	ctx, done := startQuery(ctx, "GetUserByEmail")
+	defer done()
+
 	query := `
-		SELECT id, created_at, updated_at, email, password
-		FROM users
-		WHERE email = ?
+		SELECT` + userColumns + `
+		FROM users u
+		WHERE u.email = ?
 	`
-	var user User
-	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRowContext(ctx, query, email))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return User{}, nil
+			return User{}, ErrNotFound
 		}
 		return User{}, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return User{}, err
-	}
 	return user, nil
 }
 
-func (c Client) GetUserByRefreshToken(token string) (*User, error) {
+func (c Client) GetUserByRefreshToken(ctx context.Context, token string) (*User, error) {
+	ctx, done := startQuery(ctx, "GetUserByRefreshToken")
+	defer done()
+
 	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
+		SELECT` + userColumns + `
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
 		WHERE rt.token = ?
 	`
 
-	var user User
-	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	user, err := scanUser(c.db.QueryRowContext(ctx, query, token))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(id)
-	if err != nil {
-		return nil, err
-	}
 
 	return &user, nil
 }
 
-func (c Client) CreateUser(params CreateUserParams) (*User, error) {
+func (c Client) CreateUser(ctx context.Context, params CreateUserParams) (*User, error) {
+	ctx, done := startQuery(ctx, "CreateUser")
+	defer done()
+
 	id := uuid.New()
 
 	query := `
@@ -107,41 +134,122 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 		VALUES
 		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
 	`
-	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
+	_, err := c.db.ExecContext(ctx, query, id.String(), params.Email, params.Password)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.GetUser(id)
+	return c.GetUser(ctx, id)
 }
 
-func (c Client) GetUser(id uuid.UUID) (*User, error) {
+func (c Client) GetUser(ctx context.Context, id uuid.UUID) (*User, error) {
+	ctx, done := startQuery(ctx, "GetUser")
+	defer done()
+
 	query := `
-		SELECT id, created_at, updated_at, email, password
-		FROM users
-		WHERE id = ?
+		SELECT` + userColumns + `
+		FROM users u
+		WHERE u.id = ?
 	`
-	var user User
-	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	user, err := scanUser(c.db.QueryRowContext(ctx, query, id.String()))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
+			return nil, ErrNotFound
 		}
 		return nil, err
 	}
-	user.ID, err = uuid.Parse(idStr)
+	return &user, nil
+}
+
+// UpdateUserPassword replaces the user's password hash.
+func (c Client) UpdateUserPassword(ctx context.Context, id uuid.UUID, passwordHash string) error {
+	ctx, done := startQuery(ctx, "UpdateUserPassword")
+	defer done()
+
+	query := `
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, passwordHash, id.String())
+	return err
+}
+
+// MarkEmailVerified records that the user confirmed email. It reports false
+// if the user's address has changed since the confirmation was sent.
+func (c Client) MarkEmailVerified(ctx context.Context, id uuid.UUID, email string) (bool, error) {
+	ctx, done := startQuery(ctx, "MarkEmailVerified")
+	defer done()
+
+	query := `
+		UPDATE users
+		SET email_verified_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND email = ?
+	`
+	res, err := c.db.ExecContext(ctx, query, time.Now().UTC(), id.String(), email)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	return &user, nil
+	n, err := res.RowsAffected()
+	return n > 0, err
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+// UpdateUserEmail changes the user's email address, which then needs to be
+// verified again.
+func (c Client) UpdateUserEmail(ctx context.Context, id uuid.UUID, email string) error {
+	ctx, done := startQuery(ctx, "UpdateUserEmail")
+	defer done()
+
 	query := `
-		DELETE FROM users
+		UPDATE users
+		SET email = ?, email_verified_at = NULL, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.ExecContext(ctx, query, email, id.String())
 	return err
 }
+
+// DeleteUser deletes the user along with their videos, tokens and login
+// history. Stored files are left for the caller to release.
+func (c Client) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	ctx, done := startQuery(ctx, "DeleteUser")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM playlists_videos WHERE playlist_id IN (SELECT id FROM playlists WHERE user_id = ?)`, id.String())
+	if err != nil {
+		return fmt.Errorf("could not delete user's playlist entries: %w", err)
+	}
+	// The user's public videos may be in other users' playlists too.
+	if err := deletePlaylistEntries(ctx, tx, `SELECT id FROM videos WHERE user_id = ?`, id.String()); err != nil {
+		return fmt.Errorf("could not remove user's videos from playlists: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM videos_tags WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)`, id.String())
+	if err != nil {
+		return fmt.Errorf("could not delete user's video tags: %w", err)
+	}
+	for _, table := range []string{
+		"playlists",
+		"videos",
+		"refresh_tokens",
+		"user_tokens",
+		"login_attempts",
+	} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = ?`, id.String()); err != nil {
+			return fmt.Errorf("could not delete user's %s: %w", table, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, id.String()); err != nil {
+		return err
+	}
+	if err := deleteUnusedTags(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -1,8 +1,11 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,6 +17,18 @@ type Video struct {
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
 	VideoURL     *string   `json:"video_url"`
+	// Thumbnail and VideoFile record where the uploaded files are stored.
+	// The public URLs are derived from them when the video is served, the
+	// URL columns only hold legacy values that couldn't be migrated.
+	Thumbnail *StoredObject `json:"-"`
+	VideoFile *StoredObject `json:"-"`
+	// ThumbnailSHA256 and VideoSHA256 are hex SHA-256 digests of the
+	// stored files, so their integrity can be checked later.
+	ThumbnailSHA256 *string `json:"thumbnail_sha256"`
+	VideoSHA256     *string `json:"video_sha256"`
+	// Tags are sorted by name. They are changed with SetVideoTags and
+	// RemoveVideoTag, UpdateVideo ignores them.
+	Tags []string `json:"tags"`
 	CreateVideoParams
 }
 
@@ -21,11 +36,31 @@ type CreateVideoParams struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	UserID      uuid.UUID `json:"user_id"`
+	// Visibility is VisibilityPublic or VisibilityPrivate. Private videos
+	// are only served to their owner. Defaults to public.
+	Visibility string `json:"visibility"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+const (
+	BackendLocal = "local"
+	BackendS3    = "s3"
+)
+
+// StoredObject locates an uploaded file. For the local backend Key is the
+// file name within the assets directory and Bucket is empty. For S3 an
+// empty Bucket means the server's configured bucket.
+type StoredObject struct {
+	Backend string
+	Bucket  string
+	Key     string
+}
+
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +68,124 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		thumbnail_backend,
+		thumbnail_bucket,
+		thumbnail_key,
+		video_backend,
+		video_bucket,
+		video_key,
+		visibility,
+		thumbnail_sha256,
+		video_sha256,
+		(
+			SELECT group_concat(t.name, ',')
+			FROM videos_tags vt
+			JOIN tags t ON t.id = vt.tag_id
+			WHERE vt.video_id = videos.id
+		)`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var thumbnail, videoFile storedObjectColumns
+	var tags sql.NullString
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&thumbnail.backend,
+		&thumbnail.bucket,
+		&thumbnail.key,
+		&videoFile.backend,
+		&videoFile.bucket,
+		&videoFile.key,
+		&video.Visibility,
+		&video.ThumbnailSHA256,
+		&video.VideoSHA256,
+		&tags,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+	video.Thumbnail = thumbnail.object()
+	video.VideoFile = videoFile.object()
+	video.Tags = []string{}
+	if tags.Valid {
+		// Tag names never contain commas.
+		video.Tags = strings.Split(tags.String, ",")
+		slices.Sort(video.Tags)
+	}
+	return video, nil
+}
+
+type storedObjectColumns struct {
+	backend, bucket, key sql.NullString
+}
+
+func (c storedObjectColumns) object() *StoredObject {
+	if !c.key.Valid {
+		return nil
+	}
+	return &StoredObject{
+		Backend: c.backend.String,
+		Bucket:  c.bucket.String,
+		Key:     c.key.String,
+	}
+}
+
+// objectArgs returns the backend, bucket and key columns for obj.
+func objectArgs(obj *StoredObject) (any, any, any) {
+	if obj == nil {
+		return nil, nil, nil
+	}
+	var bucket any
+	if obj.Bucket != "" {
+		bucket = obj.Bucket
+	}
+	return obj.Backend, bucket, obj.Key
+}
+
+// GetVideos returns the user's videos, newest first. If tags are given,
+// only videos carrying all of them are returned.
+func (c Client) GetVideos(ctx context.Context, userID uuid.UUID, tags ...string) ([]Video, error) {
+	ctx, done := startQuery(ctx, "GetVideos")
+	defer done()
+
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE user_id = ?
-	ORDER BY created_at DESC
 	`
+	args := []any{userID}
+	if len(tags) > 0 {
+		tags = slices.Compact(slices.Sorted(slices.Values(tags)))
+		query += `
+		AND id IN (
+			SELECT vt.video_id
+			FROM videos_tags vt
+			JOIN tags t ON t.id = vt.tag_id
+			WHERE t.name IN (?` + strings.Repeat(", ?", len(tags)-1) + `)
+			GROUP BY vt.video_id
+			HAVING COUNT(*) = ?
+		)
+		`
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+		args = append(args, len(tags))
+	}
+	query += `ORDER BY created_at DESC`
 
-	rows, err := c.db.Query(query, userID)
+	rows, err := c.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,26 +193,20 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
 }
 
-func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+func (c Client) CreateVideo(ctx context.Context, params CreateVideoParams) (Video, error) {
+	ctx, done := startQuery(ctx, "CreateVideo")
+	defer done()
+
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,45 +215,36 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	_, err := c.db.ExecContext(ctx, query, id, params.Title, params.Description, params.UserID, visibility)
 	if err != nil {
 		return Video{}, err
 	}
 
-	return c.GetVideo(id)
+	return c.GetVideo(ctx, id)
 }
 
-func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+func (c Client) GetVideo(ctx context.Context, id uuid.UUID) (Video, error) {
+	ctx, done := startQuery(ctx, "GetVideo")
+	defer done()
+
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return Video{}, nil
+			return Video{}, ErrNotFound
 		}
 		return Video{}, err
 	}
@@ -121,7 +252,49 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+// LocalObjectVisible reports whether a public video, or one owned by
+// userID, stores its thumbnail or video file locally under key. Uploads
+// are deduplicated, so several videos with different owners and
+// visibilities may share the file. Pass uuid.Nil to check for public
+// videos only.
+func (c Client) LocalObjectVisible(ctx context.Context, key string, userID uuid.UUID) (bool, error) {
+	ctx, done := startQuery(ctx, "LocalObjectVisible")
+	defer done()
+
+	query := `
+	SELECT EXISTS (
+		SELECT 1
+		FROM videos
+		WHERE ((thumbnail_backend = ? AND thumbnail_key = ?)
+			OR (video_backend = ? AND video_key = ?))
+			AND (visibility = ? OR user_id = ?)
+	)
+	`
+
+	var visible bool
+	err := c.db.QueryRowContext(ctx, query, BackendLocal, key, BackendLocal, key, VisibilityPublic, userID).Scan(&visible)
+	return visible, err
+}
+
+// UpdateVideo saves video and sets its UpdatedAt to the current time.
+func (c Client) UpdateVideo(ctx context.Context, video *Video) error {
+	ctx, done := startQuery(ctx, "UpdateVideo")
+	defer done()
+
+	return c.updateVideo(ctx, video, nil)
+}
+
+// UpdateVideoIfUnmodified saves video like UpdateVideo, provided the stored
+// video was last updated at updatedAt. Otherwise it returns ErrConflict, or
+// ErrNotFound if the video no longer exists.
+func (c Client) UpdateVideoIfUnmodified(ctx context.Context, video *Video, updatedAt time.Time) error {
+	ctx, done := startQuery(ctx, "UpdateVideoIfUnmodified")
+	defer done()
+
+	return c.updateVideo(ctx, video, &updatedAt)
+}
+
+func (c Client) updateVideo(ctx context.Context, video *Video, ifUpdatedAt *time.Time) error {
 	query := `
 	UPDATE videos
 	SET
@@ -129,27 +302,105 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		thumbnail_backend = ?,
+		thumbnail_bucket = ?,
+		thumbnail_key = ?,
+		video_backend = ?,
+		video_bucket = ?,
+		video_key = ?,
+		visibility = ?,
+		thumbnail_sha256 = ?,
+		video_sha256 = ?,
+		updated_at = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
-		query,
+	now := nextUpdatedAt(video.UpdatedAt)
+	tnBackend, tnBucket, tnKey := objectArgs(video.Thumbnail)
+	vidBackend, vidBucket, vidKey := objectArgs(video.VideoFile)
+	args := []any{
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
 		video.UserID,
+		tnBackend,
+		tnBucket,
+		tnKey,
+		vidBackend,
+		vidBucket,
+		vidKey,
+		video.Visibility,
+		video.ThumbnailSHA256,
+		video.VideoSHA256,
+		now,
 		video.ID,
-	)
-	return err
+	}
+	if ifUpdatedAt != nil {
+		// Compared at millisecond precision, since rows created with
+		// CURRENT_TIMESTAMP store the time in another format.
+		query += ` AND strftime('%Y-%m-%d %H:%M:%f', updated_at) = strftime('%Y-%m-%d %H:%M:%f', ?)`
+		args = append(args, ifUpdatedAt.UTC())
+	}
+
+	res, err := c.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var exists bool
+		err := c.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM videos WHERE id = ?)`, video.ID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		return ErrConflict
+	}
+
+	video.UpdatedAt = now
+	return nil
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
-	query := `
-	DELETE FROM videos
-	WHERE id = ?
-	`
-	_, err := c.db.Exec(query, id)
-	return err
+// nextUpdatedAt returns the time to record as a video's updated_at when it
+// changes. It is always after prev, so every change yields a new version
+// even within the same millisecond.
+func nextUpdatedAt(prev time.Time) time.Time {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if !now.After(prev) {
+		now = prev.UTC().Truncate(time.Millisecond).Add(time.Millisecond)
+	}
+	return now
+}
+
+func (c Client) DeleteVideo(ctx context.Context, id uuid.UUID) error {
+	ctx, done := startQuery(ctx, "DeleteVideo")
+	defer done()
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deletePlaylistEntries(ctx, tx, `SELECT ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM videos_tags WHERE video_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM videos WHERE id = ?`, id); err != nil {
+		return err
+	}
+	if err := deleteUnusedTags(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
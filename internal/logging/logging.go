@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// New builds a logger writing to w. level is one of debug, info, warn or
+// error and format is either text or json. Records logged with a context
+// carrying attributes from WithAttrs or AddAttrs include those attributes.
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q, must be text or json", format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+type ctxKey struct{}
+
+// attrSet is shared by everything handling one request, so attributes
+// added deep in a handler also show up when a caller higher up logs.
+type attrSet struct {
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+func (s *attrSet) add(attrs ...slog.Attr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *attrSet) snapshot() []slog.Attr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]slog.Attr(nil), s.attrs...)
+}
+
+// WithAttrs returns a child context whose log records include attrs in
+// addition to any attributes already carried by ctx.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	set := &attrSet{}
+	if parent, ok := ctx.Value(ctxKey{}).(*attrSet); ok {
+		set.add(parent.snapshot()...)
+	}
+	set.add(attrs...)
+	return context.WithValue(ctx, ctxKey{}, set)
+}
+
+// AddAttrs attaches attrs to the attribute set already carried by ctx, so
+// they are visible to every holder of that context. It is a no-op if ctx
+// was not derived from WithAttrs.
+func AddAttrs(ctx context.Context, attrs ...slog.Attr) {
+	if set, ok := ctx.Value(ctxKey{}).(*attrSet); ok {
+		set.add(attrs...)
+	}
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if set, ok := ctx.Value(ctxKey{}).(*attrSet); ok {
+		r.AddAttrs(set.snapshot()...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
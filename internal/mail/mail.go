@@ -0,0 +1,123 @@
+// Package mail sends transactional email such as address verification and
+// password reset links.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// format renders msg as an RFC 5322 message with a plain text body.
+func format(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader rejects values that would let a caller inject headers.
+func validHeader(s string) error {
+	if strings.ContainsAny(s, "\r\n") {
+		return fmt.Errorf("invalid header value %q", s)
+	}
+	return nil
+}
+
+// SMTP sends mail through an SMTP server, using STARTTLS when the server
+// offers it and PLAIN authentication when a username is set.
+type SMTP struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTP) Send(ctx context.Context, msg Message) error {
+	for _, h := range []string{msg.To, msg.Subject} {
+		if err := validHeader(h); err != nil {
+			return err
+		}
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// smtp.SendMail doesn't take a context, so give up waiting for it
+	// when ctx is done. The send itself is bounded by the server.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, format(m.From, msg))
+	}()
+	select {
+	case err := <-errc:
+		if err != nil {
+			return fmt.Errorf("could not send mail: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// File is a Mailer for local development. It logs every message and, if
+// Dir is set, writes it there as an .eml file instead of delivering it.
+type File struct {
+	Dir  string
+	From string
+}
+
+func (m File) Send(ctx context.Context, msg Message) error {
+	for _, h := range []string{msg.To, msg.Subject} {
+		if err := validHeader(h); err != nil {
+			return err
+		}
+	}
+
+	if m.Dir == "" {
+		slog.InfoContext(ctx, "mail not sent, logged instead", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := time.Now().UTC().Format("20060102T150405") + "-" + uuid.NewString() + ".eml"
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, format(m.From, msg), 0o644); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "mail written to file", "to", msg.To, "subject", msg.Subject, "path", path)
+	return nil
+}
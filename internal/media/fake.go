@@ -0,0 +1,94 @@
+package media
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory Processor for tests. It never runs external
+// binaries: Probe returns the configured result and the file producing
+// methods copy their input to a new path so callers can clean up as usual.
+type Fake struct {
+	ProbeResult ProbeResult
+	ProbeErr    error
+	ProcessErr  error
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func NewFake(result ProbeResult) *Fake {
+	return &Fake{ProbeResult: result}
+}
+
+// Calls returns the names of the methods invoked so far, in order.
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *Fake) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *Fake) Probe(ctx context.Context, filePath string) (ProbeResult, error) {
+	f.record("Probe")
+	if err := ctx.Err(); err != nil {
+		return ProbeResult{}, err
+	}
+	if f.ProbeErr != nil {
+		return ProbeResult{}, f.ProbeErr
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return ProbeResult{}, err
+	}
+	return f.ProbeResult, nil
+}
+
+func (f *Fake) FastStart(ctx context.Context, filePath string) (string, error) {
+	f.record("FastStart")
+	return f.copy(ctx, filePath, filePath+".processing")
+}
+
+func (f *Fake) Transcode(ctx context.Context, filePath string, opts TranscodeOptions) (string, error) {
+	f.record("Transcode")
+	return f.copy(ctx, filePath, filePath+".transcoded")
+}
+
+func (f *Fake) ExtractFrame(ctx context.Context, filePath string, at time.Duration) (string, error) {
+	f.record("ExtractFrame")
+	return f.copy(ctx, filePath, filePath+".frame.jpg")
+}
+
+func (f *Fake) copy(ctx context.Context, src, dst string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	if f.ProcessErr != nil {
+		return "", f.ProcessErr
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return dst, nil
+}
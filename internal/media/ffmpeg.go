@@ -0,0 +1,165 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FFmpeg implements Processor by shelling out to the ffprobe and ffmpeg
+// binaries found on PATH.
+type FFmpeg struct {
+	probeTimeout   time.Duration
+	processTimeout time.Duration
+}
+
+func NewFFmpeg(probeTimeout, processTimeout time.Duration) *FFmpeg {
+	return &FFmpeg{
+		probeTimeout:   probeTimeout,
+		processTimeout: processTimeout,
+	}
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+func (f *FFmpeg) Probe(ctx context.Context, filePath string) (ProbeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, f.probeTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+
+	var output, stderr bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		slog.WarnContext(ctx, "ffprobe failed", "error", err, "stderr", lastLine(stderr.String()))
+		if ctx.Err() != nil {
+			return ProbeResult{}, ctx.Err()
+		}
+		return ProbeResult{}, err
+	}
+
+	var probed ffprobeOutput
+	if err := json.Unmarshal(output.Bytes(), &probed); err != nil {
+		return ProbeResult{}, fmt.Errorf("could not unmarshal ffprobe output: %w", err)
+	}
+
+	var result ProbeResult
+	for _, stream := range probed.Streams {
+		if stream.CodecType == "video" {
+			result.Width = stream.Width
+			result.Height = stream.Height
+			break
+		}
+	}
+	if result.Width == 0 || result.Height == 0 {
+		return ProbeResult{}, errors.New("ffprobe found no video stream")
+	}
+
+	if probed.Format.Duration != "" {
+		seconds, err := strconv.ParseFloat(probed.Format.Duration, 64)
+		if err == nil {
+			result.Duration = time.Duration(seconds * float64(time.Second))
+		}
+	}
+
+	slog.DebugContext(ctx, "video probed", "width", result.Width, "height", result.Height, "duration", result.Duration)
+	return result, nil
+}
+
+func (f *FFmpeg) FastStart(ctx context.Context, filePath string) (string, error) {
+	outputFilePath := filePath + ".processing"
+	err := f.run(ctx, outputFilePath, "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outputFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	slog.DebugContext(ctx, "video processed for fast start")
+	return outputFilePath, nil
+}
+
+func (f *FFmpeg) Transcode(ctx context.Context, filePath string, opts TranscodeOptions) (string, error) {
+	videoCodec := opts.VideoCodec
+	if videoCodec == "" {
+		videoCodec = "libx264"
+	}
+	audioCodec := opts.AudioCodec
+	if audioCodec == "" {
+		audioCodec = "aac"
+	}
+
+	outputFilePath := filePath + ".transcoded"
+	args := []string{"-i", filePath, "-c:v", videoCodec, "-c:a", audioCodec}
+	if opts.Height > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:%d", opts.Height))
+	}
+	args = append(args, "-movflags", "faststart", "-f", "mp4", outputFilePath)
+
+	if err := f.run(ctx, outputFilePath, args...); err != nil {
+		return "", err
+	}
+
+	slog.DebugContext(ctx, "video transcoded", "height", opts.Height, "video_codec", videoCodec)
+	return outputFilePath, nil
+}
+
+func (f *FFmpeg) ExtractFrame(ctx context.Context, filePath string, at time.Duration) (string, error) {
+	outputFilePath := filePath + ".frame.jpg"
+	seek := strconv.FormatFloat(at.Seconds(), 'f', 3, 64)
+	err := f.run(ctx, outputFilePath, "-ss", seek, "-i", filePath, "-frames:v", "1", "-f", "image2", outputFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	slog.DebugContext(ctx, "frame extracted", "at", at)
+	return outputFilePath, nil
+}
+
+// run executes ffmpeg with the given arguments, removing outputFilePath if
+// the command fails or is cancelled part way through.
+func (f *FFmpeg) run(ctx context.Context, outputFilePath string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, f.processTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", append([]string{"-y"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	slog.DebugContext(ctx, "running ffmpeg", "args", cmd.Args)
+
+	if err := cmd.Run(); err != nil {
+		slog.WarnContext(ctx, "ffmpeg failed", "error", err, "stderr", lastLine(stderr.String()))
+		// ffmpeg may have written a partial output before being killed
+		os.Remove(outputFilePath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,59 @@
+package media
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Processor is the toolkit used by the upload pipeline to inspect and
+// rewrite media files on local disk. Every method that produces a file
+// returns the path of a new file which the caller is responsible for
+// removing.
+type Processor interface {
+	Probe(ctx context.Context, filePath string) (ProbeResult, error)
+	FastStart(ctx context.Context, filePath string) (string, error)
+	Transcode(ctx context.Context, filePath string, opts TranscodeOptions) (string, error)
+	ExtractFrame(ctx context.Context, filePath string, at time.Duration) (string, error)
+}
+
+type ProbeResult struct {
+	Width    int
+	Height   int
+	Duration time.Duration
+}
+
+type TranscodeOptions struct {
+	// Height of the output video in pixels, width is scaled to keep the
+	// aspect ratio. Zero keeps the source resolution.
+	Height int
+	// VideoCodec is passed to ffmpeg as -c:v, defaults to libx264.
+	VideoCodec string
+	// AudioCodec is passed to ffmpeg as -c:a, defaults to aac.
+	AudioCodec string
+}
+
+const (
+	OrientationLandscape = "landscape"
+	OrientationPortrait  = "portrait"
+	OrientationOther     = "other"
+)
+
+// Orientation classifies the probed dimensions as 16:9, 9:16 or other.
+func (p ProbeResult) Orientation() string {
+	if p.Width == 0 || p.Height == 0 {
+		return OrientationOther
+	}
+	ratio := float64(p.Width) / float64(p.Height)
+
+	const tolerance = 0.02 // 2% tolerance
+
+	switch {
+	case math.Abs(ratio-16.0/9.0) < tolerance: // ~1.778
+		return OrientationLandscape
+	case math.Abs(ratio-9.0/16.0) < tolerance: // ~0.5625
+		return OrientationPortrait
+	default:
+		return OrientationOther
+	}
+}
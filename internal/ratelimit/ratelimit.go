@@ -0,0 +1,107 @@
+// Package ratelimit implements token bucket rate limiting over a pluggable
+// store of buckets.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit describes a token bucket: it holds up to Burst tokens and refills
+// at Rate tokens per second. Each request takes one token. Rate and Burst
+// must be positive.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute returns a Limit allowing n requests a minute on average, with
+// bursts of up to burst requests.
+func PerMinute(n, burst int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: burst}
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+	// Remaining is the number of whole tokens left in the bucket.
+	Remaining int
+	// RetryAfter is how long until a token is available when the request
+	// was not allowed.
+	RetryAfter time.Duration
+}
+
+// Store keeps buckets by key. MemoryStore suits a single instance; running
+// several instances behind a load balancer needs a shared implementation,
+// e.g. backed by Redis, so that limits apply across them.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled, after which it is
+	// indistinguishable from a new one.
+	full time.Time
+}
+
+// MemoryStore is an in-process Store. Buckets that have refilled are
+// dropped periodically so the map doesn't grow with every client seen.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// sweepInterval is how often full buckets are dropped from a MemoryStore.
+const sweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	if b.tokens < 1 {
+		return Result{RetryAfter: seconds((1 - b.tokens) / limit.Rate)}, nil
+	}
+	b.tokens--
+	b.full = now.Add(seconds((float64(limit.Burst) - b.tokens) / limit.Rate))
+	return Result{Allowed: true, Remaining: int(b.tokens)}, nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
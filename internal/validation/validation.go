@@ -0,0 +1,143 @@
+// Package validation checks user supplied fields and collects every
+// problem found, so clients can show them all at once.
+//
+// Rules return an empty string when the value is acceptable and a message
+// describing the problem otherwise:
+//
+//	var errs validation.Errors
+//	errs.Check("email", validation.Required(email), validation.Email(email))
+//	if err := errs.Err(); err != nil {
+//		// respond with 422 and err
+//	}
+package validation
+
+import (
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FieldError describes why one field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors collects field errors. The zero value is ready to use.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Check records the first non-empty message for field. Rules are listed in
+// order of importance, so a missing value isn't also reported as too short.
+func (e *Errors) Check(field string, messages ...string) {
+	for _, msg := range messages {
+		if msg != "" {
+			*e = append(*e, FieldError{Field: field, Message: msg})
+			return
+		}
+	}
+}
+
+// Err returns e as an error, or nil if no field was rejected.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 256
+	MaxEmailLength    = 254
+)
+
+func Required(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "is required"
+	}
+	return ""
+}
+
+// Email accepts a bare address such as "boots@example.com", without a
+// display name.
+func Email(s string) string {
+	if len(s) > MaxEmailLength {
+		return fmt.Sprintf("must be at most %d characters", MaxEmailLength)
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return "must be a valid email address, e.g. boots@example.com"
+	}
+	return ""
+}
+
+// Password requires MinPasswordLength characters mixing letters with
+// digits or symbols.
+func Password(s string) string {
+	n := utf8.RuneCountInString(s)
+	if n < MinPasswordLength {
+		return fmt.Sprintf("must be at least %d characters", MinPasswordLength)
+	}
+	if n > MaxPasswordLength {
+		return fmt.Sprintf("must be at most %d characters", MaxPasswordLength)
+	}
+	var letter, other bool
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			letter = true
+		} else {
+			other = true
+		}
+	}
+	if !letter || !other {
+		return "must contain letters and at least one digit or symbol"
+	}
+	return ""
+}
+
+// Length checks that s has between min and max characters.
+func Length(s string, min, max int) string {
+	n := utf8.RuneCountInString(s)
+	if n < min {
+		return fmt.Sprintf("must be at least %d characters", min)
+	}
+	if n > max {
+		return fmt.Sprintf("must be at most %d characters", max)
+	}
+	return ""
+}
+
+// NoControlChars rejects invalid UTF-8 and control characters, except
+// newlines and tabs when multiline is set.
+func NoControlChars(s string, multiline bool) string {
+	if !utf8.ValidString(s) {
+		return "must be valid UTF-8"
+	}
+	for _, r := range s {
+		if multiline && (r == '\n' || r == '\r' || r == '\t') {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return "must not contain control characters"
+		}
+	}
+	return ""
+}
+
+func OneOf(s string, allowed ...string) string {
+	if !slices.Contains(allowed, s) {
+		return "must be one of " + strings.Join(allowed, ", ")
+	}
+	return ""
+}
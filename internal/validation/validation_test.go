@@ -0,0 +1,172 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	var errs Errors
+	if err := errs.Err(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	errs.Check("title", "", "")
+	errs.Check("email", Required(""), Email(""))
+	errs.Check("password", "", "too short", "too weak")
+	want := Errors{
+		{Field: "email", Message: "is required"},
+		{Field: "password", Message: "too short"},
+	}
+	if len(errs) != len(want) || errs[0] != want[0] || errs[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, errs)
+	}
+	if got := errs.Err().Error(); got != "email: is required; password: too short" {
+		t.Errorf("unexpected error text %q", got)
+	}
+}
+
+// check runs rule over each case, expecting a message exactly when
+// wantErr is set.
+func check(t *testing.T, rule func(string) string, tests []struct {
+	name    string
+	s       string
+	wantErr bool
+}) {
+	t.Helper()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := rule(tc.s)
+			if tc.wantErr && msg == "" {
+				t.Errorf("expected %q to be rejected", tc.s)
+			}
+			if !tc.wantErr && msg != "" {
+				t.Errorf("expected %q to be accepted, got %q", tc.s, msg)
+			}
+		})
+	}
+}
+
+func TestRequired(t *testing.T) {
+	check(t, Required, []struct {
+		name    string
+		s       string
+		wantErr bool
+	}{
+		{name: "value", s: "a"},
+		{name: "padded value", s: " a "},
+		{name: "empty", s: "", wantErr: true},
+		{name: "whitespace", s: " \t\n", wantErr: true},
+	})
+}
+
+func TestEmail(t *testing.T) {
+	domain := "@example.com"
+	check(t, Email, []struct {
+		name    string
+		s       string
+		wantErr bool
+	}{
+		{name: "address", s: "boots@example.com"},
+		{name: "plus and dots", s: "boots.bear+tubely@mail.example.com"},
+		{name: "longest", s: strings.Repeat("a", MaxEmailLength-len(domain)) + domain},
+		{name: "too long", s: strings.Repeat("a", MaxEmailLength-len(domain)+1) + domain, wantErr: true},
+		{name: "multibyte length counts bytes", s: strings.Repeat("é", 122) + domain, wantErr: true},
+		{name: "empty", s: "", wantErr: true},
+		{name: "no at sign", s: "boots.example.com", wantErr: true},
+		{name: "no domain", s: "boots@", wantErr: true},
+		{name: "display name", s: "Boots <boots@example.com>", wantErr: true},
+		{name: "angle brackets", s: "<boots@example.com>", wantErr: true},
+		{name: "surrounding spaces", s: " boots@example.com ", wantErr: true},
+		{name: "two addresses", s: "boots@example.com, bear@example.com", wantErr: true},
+	})
+}
+
+func TestPassword(t *testing.T) {
+	check(t, Password, []struct {
+		name    string
+		s       string
+		wantErr bool
+	}{
+		{name: "letters and digit", s: "hunter22"},
+		{name: "letters and symbol", s: "hunter-bear"},
+		{name: "letters and space", s: "correct horse"},
+		{name: "multibyte at minimum", s: "ééééééé1"},
+		{name: "longest", s: strings.Repeat("a", MaxPasswordLength-1) + "1"},
+		{name: "too short", s: "hunter2", wantErr: true},
+		{name: "multibyte too short counts characters", s: "éééééé1", wantErr: true},
+		{name: "too long", s: strings.Repeat("a", MaxPasswordLength) + "1", wantErr: true},
+		{name: "multibyte too long", s: strings.Repeat("é", MaxPasswordLength) + "1", wantErr: true},
+		{name: "letters only", s: "hunterbear", wantErr: true},
+		{name: "digits only", s: "12345678", wantErr: true},
+		{name: "empty", s: "", wantErr: true},
+	})
+}
+
+func TestLength(t *testing.T) {
+	check(t, func(s string) string { return Length(s, 2, 4) }, []struct {
+		name    string
+		s       string
+		wantErr bool
+	}{
+		{name: "minimum", s: "ab"},
+		{name: "maximum", s: "abcd"},
+		{name: "multibyte maximum", s: "日本語語"},
+		{name: "combining marks count as characters", s: "e\u0301e\u0301e", wantErr: true},
+		{name: "too short", s: "a", wantErr: true},
+		{name: "too long", s: "abcde", wantErr: true},
+		{name: "multibyte too long", s: "日本語語語", wantErr: true},
+		{name: "multibyte too short", s: "日", wantErr: true},
+	})
+}
+
+func TestNoControlChars(t *testing.T) {
+	tests := []struct {
+		name      string
+		s         string
+		multiline bool
+		wantErr   bool
+	}{
+		{name: "plain", s: "Boots the bear"},
+		{name: "multibyte", s: "Bär 🐻"},
+		{name: "empty", s: ""},
+		{name: "newline", s: "a\nb", wantErr: true},
+		{name: "tab", s: "a\tb", wantErr: true},
+		{name: "multiline newline", s: "a\r\nb", multiline: true},
+		{name: "multiline tab", s: "a\tb", multiline: true},
+		{name: "null", s: "a\x00b", multiline: true, wantErr: true},
+		{name: "escape", s: "a\x1b[31mb", multiline: true, wantErr: true},
+		{name: "delete", s: "a\x7fb", wantErr: true},
+		{name: "C1 control", s: "a\u0085b", multiline: true, wantErr: true},
+		{name: "invalid UTF-8", s: "a\xffb", wantErr: true},
+		{name: "truncated multibyte", s: "\xe6\x97", wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := NoControlChars(tc.s, tc.multiline)
+			if tc.wantErr && msg == "" {
+				t.Errorf("expected %q to be rejected", tc.s)
+			}
+			if !tc.wantErr && msg != "" {
+				t.Errorf("expected %q to be accepted, got %q", tc.s, msg)
+			}
+		})
+	}
+}
+
+func TestOneOf(t *testing.T) {
+	check(t, func(s string) string { return OneOf(s, "public", "private") }, []struct {
+		name    string
+		s       string
+		wantErr bool
+	}{
+		{name: "first", s: "public"},
+		{name: "second", s: "private"},
+		{name: "other", s: "unlisted", wantErr: true},
+		{name: "case differs", s: "Public", wantErr: true},
+		{name: "empty", s: "", wantErr: true},
+	})
+	if got := OneOf("x", "a", "b"); got != "must be one of a, b" {
+		t.Errorf("unexpected message %q", got)
+	}
+}
@@ -2,30 +2,84 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/validation"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
-	if err != nil {
-		log.Println(err)
+// maxJSONBodyBytes caps JSON request bodies, which are all small objects.
+const maxJSONBodyBytes = 1 << 20
+
+// respondWithValidationError responds with 422, listing every rejected
+// field in the error's details.
+func respondWithValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	var fields validation.Errors
+	if !errors.As(err, &fields) {
+		respondWithError(w, r, http.StatusUnprocessableEntity, err.Error(), nil)
+		return
 	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+	respondWithAPIError(w, r, http.StatusUnprocessableEntity, apiError{
+		Code:    codeValidationFailed,
+		Message: "Invalid parameters",
+		Details: fields,
+	}, err)
+}
+
+// decodeJSON reads a single JSON object from the request body into dst.
+// Unknown fields are rejected so misspelt ones don't silently do nothing.
+// If the body can't be decoded it responds with 400 (413 if too large)
+// and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(dst)
+	if err == nil && decoder.More() {
+		err = errors.New("trailing data after JSON object")
 	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	if err == nil {
+		return true
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, r, http.StatusRequestEntityTooLarge, "Request body is too large", err)
+		return false
+	}
+	respondWithError(w, r, http.StatusBadRequest, decodeErrorMessage(err), err)
+	return false
+}
+
+// decodeErrorMessage describes a JSON decoding error for the client.
+func decodeErrorMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "Request body must not be empty"
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return "Request body must be valid JSON"
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return "Request body must be a JSON object"
+		}
+		return fmt.Sprintf("Field %q must be of type %s", typeErr.Field, typeErr.Type)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields.
+		return "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+	return "Couldn't decode parameters"
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("error marshalling JSON", "error", err)
 		w.WriteHeader(500)
 		return
 	}
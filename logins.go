@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultLoginAttemptsLimit = 20
+	maxLoginAttemptsLimit     = 100
+)
+
+// lockedUntil returns when the lockout earned by failures ends, or the zero
+// time if the account isn't locked. The first lockout lasts loginLockout
+// and each further failure doubles it, up to loginLockoutMax.
+func (cfg *apiConfig) lockedUntil(failures database.LoginFailures) time.Time {
+	if failures.Count < cfg.loginMaxFailures {
+		return time.Time{}
+	}
+	lockout := cfg.loginLockout
+	for i := cfg.loginMaxFailures; i < failures.Count && lockout < cfg.loginLockoutMax; i++ {
+		lockout *= 2
+	}
+	return failures.Last.Add(min(lockout, cfg.loginLockoutMax))
+}
+
+// recordLoginAttempt audits a sign-in. Failing to record one is logged but
+// doesn't fail the request.
+func (cfg *apiConfig) recordLoginAttempt(ctx context.Context, r *http.Request, userID *uuid.UUID, email, result string) {
+	err := cfg.db.CreateLoginAttempt(ctx, database.CreateLoginAttemptParams{
+		UserID:    userID,
+		Email:     email,
+		IP:        cfg.clientIP(r),
+		UserAgent: r.UserAgent(),
+		Result:    result,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "could not record login attempt", "result", result, "error", err)
+	}
+}
+
+// handlerLoginAttemptsGet lists the caller's recent sign-in attempts,
+// including failed ones, so they can spot activity they don't recognise.
+func (cfg *apiConfig) handlerLoginAttemptsGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
+
+	limit := defaultLoginAttemptsLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxLoginAttemptsLimit {
+			respondWithError(w, r, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxLoginAttemptsLimit), err)
+			return
+		}
+	}
+
+	attempts, err := cfg.db.GetLoginAttempts(r.Context(), userID, limit)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve login attempts", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, attempts)
+}
@@ -2,13 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mail"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/tracing"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -16,7 +28,8 @@ import (
 
 type apiConfig struct {
 	db               database.Client
-	s3Client         *s3.Client
+	s3Client         s3API
+	media            media.Processor
 	jwtSecret        string
 	platform         string
 	filepathRoot     string
@@ -25,6 +38,51 @@ type apiConfig struct {
 	s3Region         string
 	s3CfDistribution string
 	port             string
+	publicBaseURL    string
+	urls             urlResolver
+	videoBackend     string
+	trustedProxies   []netip.Prefix
+
+	maxVideoUploadBytes     int64
+	maxThumbnailUploadBytes int64
+	accessTokenTTL          time.Duration
+	refreshTokenTTL         time.Duration
+	loginMaxFailures        int
+	loginLockout            time.Duration
+	loginLockoutMax         time.Duration
+	emailVerificationTTL    time.Duration
+	passwordResetTTL        time.Duration
+	cacheMaxAge             time.Duration
+	s3UploadTimeout         time.Duration
+	shutdownTimeout         time.Duration
+
+	tempDir     string
+	uploads     *jobTracker
+	progress    *progressHub
+	assetHashes *hashCache
+	rateLimiter ratelimit.Store
+	mailer      mail.Mailer
+}
+
+// newMailer returns the mailer selected by conf.MailBackend.
+func newMailer(conf config.Config) mail.Mailer {
+	if conf.MailBackend == "smtp" {
+		return mail.SMTP{
+			Addr:     conf.SMTPAddr,
+			Username: conf.SMTPUsername,
+			Password: conf.SMTPPassword,
+			From:     conf.MailFrom,
+		}
+	}
+	return mail.File{Dir: conf.MailDir, From: conf.MailFrom}
+}
+
+// s3API is the subset of the S3 client used by the handlers, so tests can
+// substitute an in-memory store.
+type s3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
 }
 
 type thumbnail struct {
@@ -35,73 +93,80 @@ type thumbnail struct {
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
+	conf, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-
-	db, err := database.NewClient(pathToDB)
 	if err != nil {
-		log.Fatalf("Couldn't connect to database: %v", err)
-	}
-
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
-	}
-
-	platform := os.Getenv("PLATFORM")
-	if platform == "" {
-		log.Fatal("PLATFORM environment variable is not set")
-	}
-
-	filepathRoot := os.Getenv("FILEPATH_ROOT")
-	if filepathRoot == "" {
-		log.Fatal("FILEPATH_ROOT environment variable is not set")
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
 
-	assetsRoot := os.Getenv("ASSETS_ROOT")
-	if assetsRoot == "" {
-		log.Fatal("ASSETS_ROOT environment variable is not set")
-	}
-
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	logger, err := logging.New(os.Stderr, conf.LogLevel, conf.LogFormat)
+	if err != nil {
+		log.Fatalf("Couldn't configure logging: %v", err)
 	}
+	slog.SetDefault(logger)
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.TraceExporter, "tubely")
+	if err != nil {
+		log.Fatalf("Couldn't configure tracing: %v", err)
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	db, err := database.NewClient(conf.DBPath)
+	if err != nil {
+		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
-	s3Config, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	s3Config, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(conf.S3Region))
 	if err != nil {
 		log.Fatal("Could not load default s3 client")
 	}
 	s3Client := s3.NewFromConfig(s3Config)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	tempDir, err := os.MkdirTemp("", "tubely-")
+	if err != nil {
+		log.Fatalf("Couldn't create temp directory: %v", err)
 	}
 
 	cfg := apiConfig{
 		db:               db,
-		s3Client:         s3Client,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		s3Client:         instrumentedS3{s3Client},
+		media:            instrumentedMedia{media.NewFFmpeg(conf.FFprobeTimeout, conf.FFmpegTimeout)},
+		jwtSecret:        conf.JWTSecret,
+		platform:         conf.Platform,
+		filepathRoot:     conf.FilepathRoot,
+		assetsRoot:       conf.AssetsRoot,
+		s3Bucket:         conf.S3Bucket,
+		s3Region:         conf.S3Region,
+		s3CfDistribution: conf.S3CfDistribution,
+		port:             conf.Port,
+		publicBaseURL:    conf.PublicBaseURL,
+		videoBackend:     conf.VideoBackend,
+		trustedProxies:   conf.TrustedProxies,
+		urls: urlResolver{
+			assetsBaseURL: conf.AssetsBaseURL,
+			s3Bucket:      conf.S3Bucket,
+			s3Region:      conf.S3Region,
+			s3CDNDomain:   conf.S3CfDistribution,
+		},
+		maxVideoUploadBytes:     conf.MaxVideoUploadBytes,
+		maxThumbnailUploadBytes: conf.MaxThumbnailUploadBytes,
+		accessTokenTTL:          conf.AccessTokenTTL,
+		refreshTokenTTL:         conf.RefreshTokenTTL,
+		loginMaxFailures:        conf.LoginMaxFailures,
+		loginLockout:            conf.LoginLockout,
+		loginLockoutMax:         conf.LoginLockoutMax,
+		emailVerificationTTL:    conf.EmailVerificationTTL,
+		passwordResetTTL:        conf.PasswordResetTTL,
+		cacheMaxAge:             conf.CacheMaxAge,
+		s3UploadTimeout:         conf.S3UploadTimeout,
+		shutdownTimeout:         conf.ShutdownTimeout,
+		tempDir:                 tempDir,
+		uploads:                 &jobTracker{},
+		progress:                newProgressHub(),
+		assetHashes:             newHashCache(),
+		rateLimiter:             ratelimit.NewMemoryStore(),
+		mailer:                  newMailer(conf),
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -110,32 +175,90 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(cfg.filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", cacheMiddleware(assetsHandler))
+	mux.HandleFunc("GET /assets/{key...}", cfg.handlerAssetGet)
 
-	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
-	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
+	// Sign-in and sign-up are limited by IP to slow down credential
+	// stuffing; uploads also per user, since one account may use many IPs.
+	authPolicy := rateLimitPolicy{name: "auth", byIP: ratelimit.PerMinute(10, 5)}
+	signupPolicy := rateLimitPolicy{name: "signup", byIP: ratelimit.PerMinute(5, 5)}
+	// Requests that send mail are limited to stop them being used to spam.
+	mailPolicy := rateLimitPolicy{
+		name:   "mail",
+		byIP:   ratelimit.PerMinute(5, 3),
+		byUser: ratelimit.PerMinute(1, 3),
+	}
+	refreshPolicy := rateLimitPolicy{name: "refresh", byIP: ratelimit.PerMinute(30, 10)}
+	uploadPolicy := rateLimitPolicy{
+		name:   "upload",
+		byIP:   ratelimit.PerMinute(30, 10),
+		byUser: ratelimit.PerMinute(10, 5),
+	}
+
+	mux.HandleFunc("POST /api/login", cfg.rateLimit(authPolicy, cfg.handlerLogin))
+	mux.HandleFunc("POST /api/refresh", cfg.rateLimit(refreshPolicy, cfg.handlerRefresh))
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
-	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/users", cfg.rateLimit(signupPolicy, cfg.handlerUsersCreate))
+	mux.HandleFunc("GET /api/users/me", cfg.handlerUserGet)
+	mux.HandleFunc("PUT /api/users/me/email", cfg.rateLimit(mailPolicy, cfg.handlerUserEmailUpdate))
+	mux.HandleFunc("PUT /api/users/me/password", cfg.rateLimit(authPolicy, cfg.handlerUserPasswordUpdate))
+	mux.HandleFunc("DELETE /api/users/me", cfg.rateLimit(authPolicy, cfg.handlerUserDelete))
+	mux.HandleFunc("GET /api/users/me/logins", cfg.handlerLoginAttemptsGet)
+	mux.HandleFunc("POST /api/email_verification", cfg.rateLimit(mailPolicy, cfg.handlerEmailVerificationRequest))
+	mux.HandleFunc("POST /api/email_verification/confirm", cfg.rateLimit(authPolicy, cfg.handlerEmailVerificationConfirm))
+	mux.HandleFunc("POST /api/password_reset", cfg.rateLimit(mailPolicy, cfg.handlerPasswordResetRequest))
+	mux.HandleFunc("POST /api/password_reset/confirm", cfg.rateLimit(authPolicy, cfg.handlerPasswordResetConfirm))
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.rateLimit(uploadPolicy, cfg.uploads.track(cfg.handlerUploadThumbnail)))
+	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.rateLimit(uploadPolicy, cfg.uploads.track(cfg.handlerUploadVideo)))
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("PUT /api/videos/{videoID}/tags", cfg.handlerVideoTagsSet)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/tags/{tag}", cfg.handlerVideoTagDelete)
+	mux.HandleFunc("GET /api/tags", cfg.handlerTagsList)
+
+	mux.HandleFunc("POST /api/playlists", cfg.handlerPlaylistCreate)
+	mux.HandleFunc("GET /api/playlists", cfg.handlerPlaylistsRetrieve)
+	mux.HandleFunc("GET /api/playlists/{playlistID}", cfg.handlerPlaylistGet)
+	mux.HandleFunc("PATCH /api/playlists/{playlistID}", cfg.handlerPlaylistUpdate)
+	mux.HandleFunc("DELETE /api/playlists/{playlistID}", cfg.handlerPlaylistDelete)
+	mux.HandleFunc("POST /api/playlists/{playlistID}/videos", cfg.handlerPlaylistVideoAdd)
+	mux.HandleFunc("PUT /api/playlists/{playlistID}/videos", cfg.handlerPlaylistReorder)
+	mux.HandleFunc("DELETE /api/playlists/{playlistID}/videos/{videoID}", cfg.handlerPlaylistVideoRemove)
+	mux.HandleFunc("POST /api/playlists/{playlistID}/videos/{videoID}/move", cfg.handlerPlaylistVideoMove)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
+
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:    ":" + cfg.port,
+		Handler: requestIDMiddleware(tracingMiddleware(metricsMiddleware(mux))),
 	}
+	// Progress streams stay open until an upload finishes, so end them
+	// instead of holding up shutdown.
+	srv.RegisterOnShutdown(cfg.progress.close)
+
+	slog.Info("serving", "url", cfg.publicBaseURL+"/app/")
+	serveErr := serveUntilSignal(srv, &cfg)
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("could not flush traces", "error", err)
+	}
+
+	if serveErr != nil {
+		log.Fatal(serveErr)
+	}
+	slog.Info("server stopped")
 }
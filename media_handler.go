@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// immutableCacheControl is sent for content-addressed files, whose name
+// changes whenever their content does.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// handlerAssetGet serves a locally stored thumbnail or video. It supports
+// byte ranges for seeking, strong ETags derived from the file content and
+// conditional requests. Files only used by private videos are served to
+// the owners of those videos, who may pass the access token in a "token"
+// query parameter since <img> and <video> elements can't set headers.
+func (cfg *apiConfig) handlerAssetGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !fs.ValidPath(key) || key == "." {
+		respondWithError(w, r, http.StatusNotFound, "Asset not found", nil)
+		return
+	}
+
+	public, err := cfg.db.LocalObjectVisible(r.Context(), key, uuid.Nil)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't look up asset", err)
+		return
+	}
+	private := !public
+	if private {
+		userID, err := cfg.authenticateMediaRequest(r)
+		if err != nil {
+			// don't reveal that a private asset exists
+			respondWithError(w, r, http.StatusNotFound, "Asset not found", err)
+			return
+		}
+		visible, err := cfg.db.LocalObjectVisible(r.Context(), key, userID)
+		if err != nil {
+			respondWithError(w, r, http.StatusInternalServerError, "Couldn't look up asset", err)
+			return
+		}
+		if !visible {
+			respondWithError(w, r, http.StatusNotFound, "Asset not found", nil)
+			return
+		}
+	}
+
+	f, err := os.Open(filepath.Join(cfg.assetsRoot, filepath.FromSlash(key)))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			respondWithError(w, r, http.StatusNotFound, "Asset not found", err)
+			return
+		}
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't open asset", err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't open asset", err)
+		return
+	}
+
+	hash, err := cfg.assetHashes.get(f, info)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't hash asset", err)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+hash+`"`)
+	switch {
+	case private:
+		w.Header().Set("Cache-Control", "private, no-cache")
+	case isContentAddressed(key, hash):
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	default:
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(cfg.cacheMaxAge.Seconds())))
+	}
+
+	// ServeContent handles Range, If-Range, If-None-Match against the ETag
+	// set above, and If-Modified-Since.
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// authenticateMediaRequest reads an access token from the Authorization
+// header or, failing that, the token query parameter.
+func (cfg *apiConfig) authenticateMediaRequest(r *http.Request) (uuid.UUID, error) {
+	token, err := auth.GetBearerToken(r.Header)
+	if errors.Is(err, auth.ErrNoAuthHeaderIncluded) {
+		token = r.URL.Query().Get("token")
+		err = nil
+		if token == "" {
+			err = auth.ErrNoAuthHeaderIncluded
+		}
+	}
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return auth.ValidateJWT(token, cfg.jwtSecret)
+}
+
+// isContentAddressed reports whether the file name, without extension, is
+// the hex SHA-256 of its content.
+func isContentAddressed(key, hash string) bool {
+	name := path.Base(key)
+	return strings.TrimSuffix(name, path.Ext(name)) == hash
+}
+
+// hashCache remembers content hashes of served files, keyed by path and
+// invalidated when the file's size or modification time changes.
+type hashCache struct {
+	mu      sync.Mutex
+	entries map[string]hashEntry
+}
+
+type hashEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{entries: make(map[string]hashEntry)}
+}
+
+// get returns the hex SHA-256 of f, leaving f positioned at its start.
+func (c *hashCache) get(f *os.File, info os.FileInfo) (string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[f.Name()]
+	c.mu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.hash, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("could not rewind asset: %w", err)
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	c.entries[f.Name()] = hashEntry{size: info.Size(), modTime: info.ModTime(), hash: hash}
+	c.mu.Unlock()
+	return hash, nil
+}
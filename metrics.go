@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/media"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+)
+
+// metricsMiddleware records request counts and latency by route. It must
+// wrap the ServeMux directly so the matched pattern is visible on r after
+// the mux has served it.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(rec.status)
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, status).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(route, r.Method, status).Observe(metrics.Since(start))
+	})
+}
+
+// instrumentedMedia times every media operation.
+type instrumentedMedia struct {
+	media.Processor
+}
+
+func (m instrumentedMedia) Probe(ctx context.Context, filePath string) (media.ProbeResult, error) {
+	start := time.Now()
+	result, err := m.Processor.Probe(ctx, filePath)
+	metrics.MediaCommandDuration.WithLabelValues("probe", metrics.Result(err)).Observe(metrics.Since(start))
+	return result, err
+}
+
+func (m instrumentedMedia) FastStart(ctx context.Context, filePath string) (string, error) {
+	start := time.Now()
+	out, err := m.Processor.FastStart(ctx, filePath)
+	metrics.MediaCommandDuration.WithLabelValues("faststart", metrics.Result(err)).Observe(metrics.Since(start))
+	return out, err
+}
+
+func (m instrumentedMedia) Transcode(ctx context.Context, filePath string, opts media.TranscodeOptions) (string, error) {
+	start := time.Now()
+	out, err := m.Processor.Transcode(ctx, filePath, opts)
+	metrics.MediaCommandDuration.WithLabelValues("transcode", metrics.Result(err)).Observe(metrics.Since(start))
+	return out, err
+}
+
+func (m instrumentedMedia) ExtractFrame(ctx context.Context, filePath string, at time.Duration) (string, error) {
+	start := time.Now()
+	out, err := m.Processor.ExtractFrame(ctx, filePath, at)
+	metrics.MediaCommandDuration.WithLabelValues("extract_frame", metrics.Result(err)).Observe(metrics.Since(start))
+	return out, err
+}
+
+// instrumentedS3 records PutObject latency and errors.
+type instrumentedS3 struct {
+	s3API
+}
+
+func (c instrumentedS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	start := time.Now()
+	out, err := c.s3API.PutObject(ctx, params, optFns...)
+	metrics.S3PutObjectDuration.WithLabelValues(metrics.Result(err)).Observe(metrics.Since(start))
+	if err != nil {
+		metrics.S3PutObjectErrors.Inc()
+	}
+	return out, err
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/validation"
+	"github.com/google/uuid"
+)
+
+// playlistResponse is a playlist with the metadata of the videos in it, in
+// order.
+type playlistResponse struct {
+	database.Playlist
+	Videos []database.Video `json:"videos"`
+}
+
+// playlistResponse loads the playlist's videos. Private videos are left out
+// unless viewerID owns them, whoever owns the playlist.
+func (cfg *apiConfig) playlistResponse(ctx context.Context, playlist database.Playlist, viewerID uuid.UUID) (playlistResponse, error) {
+	videos, err := cfg.db.GetPlaylistVideos(ctx, playlist.ID)
+	if err != nil {
+		return playlistResponse{}, err
+	}
+	visible := []database.Video{}
+	for _, video := range videos {
+		if video.Visibility == database.VisibilityPrivate && video.UserID != viewerID {
+			continue
+		}
+		cfg.resolveURLs(&video)
+		visible = append(visible, video)
+	}
+	return playlistResponse{Playlist: playlist, Videos: visible}, nil
+}
+
+func (cfg *apiConfig) respondWithPlaylist(w http.ResponseWriter, r *http.Request, status int, playlist database.Playlist, viewerID uuid.UUID) {
+	resp, err := cfg.playlistResponse(r.Context(), playlist, viewerID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get playlist videos", err)
+		return
+	}
+	respondWithJSON(w, status, resp)
+}
+
+// validatePlaylistRequest is validateRequest for playlist routes.
+func validatePlaylistRequest(cfg *apiConfig, w http.ResponseWriter, r *http.Request) (uuid.UUID, uuid.UUID, error) {
+	playlistID, err := uuid.Parse(r.PathValue("playlistID"))
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid ID", err)
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+	logging.AddAttrs(r.Context(), slog.String("playlist_id", playlistID.String()))
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return uuid.UUID{}, uuid.UUID{}, err
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
+
+	return playlistID, userID, nil
+}
+
+// getPlaylist is getVideoMetadata for playlists: it loads a playlist the
+// user owns.
+func getPlaylist(cfg *apiConfig, w http.ResponseWriter, r *http.Request, playlistID, userID uuid.UUID) (database.Playlist, error) {
+	playlist, err := cfg.db.GetPlaylist(r.Context(), playlistID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Playlist not found", err)
+		return database.Playlist{}, err
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get playlist", err)
+		return database.Playlist{}, err
+	}
+	if playlist.UserID != userID {
+		err := errors.New("playlist belongs to another user")
+		respondWithError(w, r, http.StatusForbidden, "You can't modify this playlist", err)
+		return database.Playlist{}, err
+	}
+	return playlist, nil
+}
+
+// checkPosition validates an optional position within a playlist.
+// Positions past the end are allowed and mean the end.
+func checkPosition(errs *validation.Errors, position *int) {
+	if position != nil && *position < 0 {
+		errs.Check("position", "must not be negative")
+	}
+}
+
+// positionOrEnd returns position, or -1 for the end of the playlist.
+func positionOrEnd(position *int) int {
+	if position == nil {
+		return -1
+	}
+	return *position
+}
+
+func (cfg *apiConfig) handlerPlaylistCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Visibility  string `json:"visibility"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPublic
+	}
+	// Playlists follow the same rules as videos for these fields.
+	if err := checkVideoFields(&params.Title, &params.Description, &params.Visibility); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	playlist, err := cfg.db.CreatePlaylist(r.Context(), database.CreatePlaylistParams{
+		Title:       params.Title,
+		Description: params.Description,
+		Visibility:  params.Visibility,
+		UserID:      userID,
+	})
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't create playlist", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, playlistResponse{Playlist: playlist, Videos: []database.Video{}})
+}
+
+// handlerPlaylistsRetrieve lists the caller's playlists without their
+// videos.
+func (cfg *apiConfig) handlerPlaylistsRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
+
+	playlists, err := cfg.db.GetPlaylists(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve playlists", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, playlists)
+}
+
+// handlerPlaylistGet serves public playlists to anyone and private ones to
+// their owner only.
+func (cfg *apiConfig) handlerPlaylistGet(w http.ResponseWriter, r *http.Request) {
+	playlistID, err := uuid.Parse(r.PathValue("playlistID"))
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid playlist ID", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("playlist_id", playlistID.String()))
+
+	playlist, err := cfg.db.GetPlaylist(r.Context(), playlistID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Playlist not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get playlist", err)
+		return
+	}
+	// Unlike media, playlists are fetched by API clients, so the token is
+	// only read from the Authorization header and never the query string,
+	// where it would end up in logs. Viewers without a valid token are
+	// anonymous, and anonymous viewers own no videos.
+	viewerID := uuid.Nil
+	var authErr error
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		viewerID, authErr = auth.ValidateJWT(token, cfg.jwtSecret)
+		if authErr != nil {
+			viewerID = uuid.Nil
+		} else {
+			logging.AddAttrs(r.Context(), slog.String("user_id", viewerID.String()))
+		}
+	}
+	if playlist.Visibility == database.VisibilityPrivate && viewerID != playlist.UserID {
+		respondWithError(w, r, http.StatusNotFound, "Playlist not found", authErr)
+		return
+	}
+
+	cfg.respondWithPlaylist(w, r, http.StatusOK, playlist, viewerID)
+}
+
+// handlerPlaylistUpdate changes the fields present in the body.
+func (cfg *apiConfig) handlerPlaylistUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+		Visibility  *string `json:"visibility"`
+	}
+
+	playlistID, userID, err := validatePlaylistRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	if err := checkVideoFields(params.Title, params.Description, params.Visibility); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	playlist, err := getPlaylist(cfg, w, r, playlistID, userID)
+	if err != nil {
+		return
+	}
+	if params.Title != nil {
+		playlist.Title = *params.Title
+	}
+	if params.Description != nil {
+		playlist.Description = *params.Description
+	}
+	if params.Visibility != nil {
+		playlist.Visibility = *params.Visibility
+	}
+
+	err = cfg.db.UpdatePlaylist(r.Context(), &playlist)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Playlist not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't update playlist", err)
+		return
+	}
+
+	cfg.respondWithPlaylist(w, r, http.StatusOK, playlist, userID)
+}
+
+// handlerPlaylistDelete deletes the playlist but not its videos.
+func (cfg *apiConfig) handlerPlaylistDelete(w http.ResponseWriter, r *http.Request) {
+	playlistID, userID, err := validatePlaylistRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+
+	if _, err := getPlaylist(cfg, w, r, playlistID, userID); err != nil {
+		return
+	}
+	if err := cfg.db.DeletePlaylist(r.Context(), playlistID); err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't delete playlist", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPlaylistVideoAdd adds one of the caller's videos, or anyone's
+// public video, at the given position or at the end.
+func (cfg *apiConfig) handlerPlaylistVideoAdd(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoID  string `json:"video_id"`
+		Position *int   `json:"position"`
+	}
+
+	playlistID, userID, err := validatePlaylistRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	var errs validation.Errors
+	videoID, err := uuid.Parse(params.VideoID)
+	if err != nil {
+		errs.Check("video_id", validation.Required(params.VideoID), "must be a valid ID")
+	}
+	checkPosition(&errs, params.Position)
+	if err := errs.Err(); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	playlist, err := getPlaylist(cfg, w, r, playlistID, userID)
+	if err != nil {
+		return
+	}
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.Visibility == database.VisibilityPrivate && video.UserID != userID {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	err = cfg.db.AddPlaylistVideo(r.Context(), &playlist, videoID, positionOrEnd(params.Position))
+	if errors.Is(err, database.ErrConflict) {
+		respondWithError(w, r, http.StatusConflict, "Video is already in the playlist", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't add video to playlist", err)
+		return
+	}
+
+	cfg.respondWithPlaylist(w, r, http.StatusOK, playlist, userID)
+}
+
+func (cfg *apiConfig) handlerPlaylistVideoRemove(w http.ResponseWriter, r *http.Request) {
+	playlistID, userID, err := validatePlaylistRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	playlist, err := getPlaylist(cfg, w, r, playlistID, userID)
+	if err != nil {
+		return
+	}
+	err = cfg.db.RemovePlaylistVideo(r.Context(), &playlist, videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Video isn't in the playlist", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't remove video from playlist", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPlaylistReorder puts the playlist's videos in the order given,
+// which must list every video in it exactly once. If videos are added or
+// removed between that check and the update it responds with 409.
+func (cfg *apiConfig) handlerPlaylistReorder(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VideoIDs []uuid.UUID `json:"video_ids"`
+	}
+
+	playlistID, userID, err := validatePlaylistRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+
+	playlist, err := getPlaylist(cfg, w, r, playlistID, userID)
+	if err != nil {
+		return
+	}
+	videos, err := cfg.db.GetPlaylistVideos(r.Context(), playlistID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get playlist videos", err)
+		return
+	}
+	if err := checkPlaylistOrder(videos, params.VideoIDs); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	err = cfg.db.ReorderPlaylist(r.Context(), &playlist, params.VideoIDs)
+	if errors.Is(err, database.ErrConflict) {
+		respondWithError(w, r, http.StatusConflict, "The playlist changed while reordering, try again", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't reorder playlist", err)
+		return
+	}
+
+	cfg.respondWithPlaylist(w, r, http.StatusOK, playlist, userID)
+}
+
+// checkPlaylistOrder checks that videoIDs lists each of the playlist's
+// videos exactly once.
+func checkPlaylistOrder(videos []database.Video, videoIDs []uuid.UUID) error {
+	inPlaylist := make(map[uuid.UUID]bool, len(videos))
+	for _, video := range videos {
+		inPlaylist[video.ID] = true
+	}
+	seen := make(map[uuid.UUID]bool, len(videoIDs))
+	var duplicate, unknown bool
+	for _, id := range videoIDs {
+		duplicate = duplicate || seen[id]
+		unknown = unknown || !inPlaylist[id]
+		seen[id] = true
+	}
+
+	var errs validation.Errors
+	switch {
+	case duplicate:
+		errs.Check("video_ids", "must not list a video more than once")
+	case unknown:
+		errs.Check("video_ids", "must only list videos in the playlist")
+	case len(seen) < len(inPlaylist):
+		errs.Check("video_ids", "must list every video in the playlist")
+	}
+	return errs.Err()
+}
+
+// handlerPlaylistVideoMove moves a video to another position in the
+// playlist, or into another of the caller's playlists when playlist_id is
+// set. Without a position the video goes to the end.
+func (cfg *apiConfig) handlerPlaylistVideoMove(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Position   *int       `json:"position"`
+		PlaylistID *uuid.UUID `json:"playlist_id"`
+	}
+
+	playlistID, userID, err := validatePlaylistRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	var errs validation.Errors
+	checkPosition(&errs, params.Position)
+	if err := errs.Err(); err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	from, err := getPlaylist(cfg, w, r, playlistID, userID)
+	if err != nil {
+		return
+	}
+	to := from
+	if params.PlaylistID != nil && *params.PlaylistID != playlistID {
+		to, err = getPlaylist(cfg, w, r, *params.PlaylistID, userID)
+		if err != nil {
+			return
+		}
+	}
+
+	err = cfg.db.MovePlaylistVideo(r.Context(), &from, videoID, &to, positionOrEnd(params.Position))
+	switch {
+	case errors.Is(err, database.ErrNotFound):
+		respondWithError(w, r, http.StatusNotFound, "Video isn't in the playlist", err)
+		return
+	case errors.Is(err, database.ErrConflict):
+		respondWithError(w, r, http.StatusConflict, "Video is already in the target playlist", err)
+		return
+	case err != nil:
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't move video", err)
+		return
+	}
+
+	cfg.respondWithPlaylist(w, r, http.StatusOK, to, userID)
+}
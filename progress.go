@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/google/uuid"
+)
+
+// Upload stages reported to progress subscribers, in pipeline order.
+const (
+	stageReceived  = "received"
+	stageProbing   = "probing"
+	stageRemuxing  = "remuxing"
+	stageUploading = "uploading"
+	stageDone      = "done"
+	stageFailed    = "failed"
+)
+
+const (
+	// progressInterval limits how often byte progress is published.
+	progressInterval = 250 * time.Millisecond
+	// heartbeatInterval keeps idle event streams from being closed by
+	// proxies while ffmpeg is busy.
+	heartbeatInterval = 15 * time.Second
+)
+
+type progressEvent struct {
+	Stage string `json:"stage"`
+	Bytes int64  `json:"bytes,omitempty"`
+	Total int64  `json:"total,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (e progressEvent) final() bool {
+	return e.Stage == stageDone || e.Stage == stageFailed
+}
+
+// progressHub fans upload progress out to the clients watching each video.
+type progressHub struct {
+	mu     sync.Mutex
+	subs   map[uuid.UUID]map[chan progressEvent]struct{}
+	last   map[uuid.UUID]progressEvent
+	closed bool
+}
+
+func newProgressHub() *progressHub {
+	return &progressHub{
+		subs: make(map[uuid.UUID]map[chan progressEvent]struct{}),
+		last: make(map[uuid.UUID]progressEvent),
+	}
+}
+
+// subscribe returns a channel of events for videoID, starting with the
+// current stage of an upload in progress. The channel is closed after a
+// final event or when the hub shuts down. cancel must be called once the
+// subscriber stops reading.
+func (h *progressHub) subscribe(videoID uuid.UUID) (<-chan progressEvent, func()) {
+	ch := make(chan progressEvent, 16)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if ev, ok := h.last[videoID]; ok {
+		ch <- ev
+	}
+	if h.subs[videoID] == nil {
+		h.subs[videoID] = make(map[chan progressEvent]struct{})
+	}
+	h.subs[videoID][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[videoID][ch]; ok {
+			h.remove(videoID, ch)
+		}
+	}
+}
+
+// publish sends ev to every subscriber of videoID. Subscribers that fall
+// behind miss intermediate events rather than stalling the upload.
+func (h *progressHub) publish(videoID uuid.UUID, ev progressEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if ev.final() {
+		delete(h.last, videoID)
+	} else {
+		h.last[videoID] = ev
+	}
+	for ch := range h.subs[videoID] {
+		select {
+		case ch <- ev:
+		default:
+			if !ev.final() {
+				continue
+			}
+			// make room so the final event always arrives
+			<-ch
+			ch <- ev
+		}
+		if ev.final() {
+			h.remove(videoID, ch)
+		}
+	}
+}
+
+// close ends every open stream; it is registered to run on server shutdown.
+func (h *progressHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for videoID, chans := range h.subs {
+		for ch := range chans {
+			h.remove(videoID, ch)
+		}
+	}
+}
+
+// remove must be called with h.mu held.
+func (h *progressHub) remove(videoID uuid.UUID, ch chan progressEvent) {
+	delete(h.subs[videoID], ch)
+	if len(h.subs[videoID]) == 0 {
+		delete(h.subs, videoID)
+	}
+	close(ch)
+}
+
+// progressReader publishes uploading events as r is read. It forwards
+// Seek so SDKs can rewind the body to compute checksums or retry.
+type progressReader struct {
+	r        io.ReadSeeker
+	read     int64
+	total    int64
+	lastSent time.Time
+	publish  func(progressEvent)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if now := time.Now(); now.Sub(p.lastSent) >= progressInterval || p.read == p.total {
+		p.lastSent = now
+		p.publish(progressEvent{Stage: stageUploading, Bytes: p.read, Total: p.total})
+	}
+	return n, err
+}
+
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.r.Seek(offset, whence)
+	if err == nil {
+		p.read = pos
+	}
+	return pos, err
+}
+
+// handlerVideoProgress streams the upload stages of a video as Server-Sent
+// Events. EventSource can't set headers, so the owner's access token may
+// be passed in the token query parameter.
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("video_id", videoID.String()))
+
+	userID, err := cfg.authenticateMediaRequest(r)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	events, cancel := cfg.progress.subscribe(videoID)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		slog.WarnContext(r.Context(), "response does not support streaming", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "could not encode progress event", "error", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
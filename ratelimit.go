@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+)
+
+// rateLimitPolicy limits a route by client IP and, for requests carrying a
+// valid access token, by user. A zero Limit disables that key.
+type rateLimitPolicy struct {
+	name   string
+	byIP   ratelimit.Limit
+	byUser ratelimit.Limit
+}
+
+// rateLimit rejects requests exceeding policy with 429 Too Many Requests
+// and a Retry-After header. If the store fails the request is let through,
+// since refusing all traffic is worse than briefly not limiting it.
+func (cfg *apiConfig) rateLimit(policy rateLimitPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		type check struct {
+			kind, key string
+			limit     ratelimit.Limit
+		}
+		var checks []check
+		if policy.byIP.Burst > 0 {
+			checks = append(checks, check{"ip", cfg.clientIP(r), policy.byIP})
+		}
+		if policy.byUser.Burst > 0 {
+			// Invalid tokens are left for the handler to reject.
+			if token, err := auth.GetBearerToken(r.Header); err == nil {
+				if userID, err := auth.ValidateJWT(token, cfg.jwtSecret); err == nil {
+					checks = append(checks, check{"user", userID.String(), policy.byUser})
+				}
+			}
+		}
+
+		for _, c := range checks {
+			res, err := cfg.rateLimiter.Take(r.Context(), policy.name+":"+c.kind+":"+c.key, c.limit)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "rate limiter unavailable", "policy", policy.name, "error", err)
+				continue
+			}
+			if !res.Allowed {
+				metrics.RateLimited.WithLabelValues(policy.name, c.kind).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(res.RetryAfter)))
+				respondWithError(w, r, http.StatusTooManyRequests, "Too many requests, try again later", nil)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// clientIP returns the address of the client. Forwarding headers are only
+// believed when they were added by one of cfg.trustedProxies, since any
+// client can set them: X-Forwarded-For is read from the right, skipping
+// the proxies, and the first address not belonging to one is the client.
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if len(cfg.trustedProxies) == 0 {
+		return client
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && cfg.isTrustedProxy(client); i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// A malformed entry can't be attributed, so the request is
+			// treated as coming from the proxy that passed it on.
+			break
+		}
+		client = addr.Unmap().String()
+	}
+	return client
+}
+
+func (cfg *apiConfig) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range cfg.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
@@ -9,9 +9,9 @@ func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := cfg.db.Reset()
+	err := cfg.db.Reset(r.Context())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't reset database", err)
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't reset database", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// cancelGracePeriod is how long handlers get to run their deferred cleanup
+// after their contexts are cancelled at the end of the shutdown deadline.
+const cancelGracePeriod = 5 * time.Second
+
+// jobTracker counts in-flight uploads so shutdown can wait for them to
+// finish processing before temp files and the database are torn down.
+type jobTracker struct {
+	wg sync.WaitGroup
+}
+
+func (t *jobTracker) track(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t.wg.Add(1)
+		defer t.wg.Done()
+		next(w, r)
+	}
+}
+
+// wait blocks until every tracked job has returned or ctx is done.
+func (t *jobTracker) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serveUntilSignal runs srv until SIGINT or SIGTERM is received, then stops
+// accepting connections and drains in-flight requests for up to
+// cfg.shutdownTimeout. Requests still running after the deadline have
+// their contexts cancelled, which kills any ffmpeg process or S3 upload
+// they started. Temp files and the database are cleaned up last.
+func serveUntilSignal(srv *http.Server, cfg *apiConfig) error {
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-signalCtx.Done():
+		stop()
+		slog.Info("shutting down, waiting for in-flight requests", "timeout", cfg.shutdownTimeout)
+		err = drain(srv, cfg, cancelRequests)
+	}
+
+	if rmErr := os.RemoveAll(cfg.tempDir); rmErr != nil {
+		slog.Error("could not remove temp dir", "error", rmErr)
+	}
+	if closeErr := cfg.db.Close(); closeErr != nil {
+		slog.Error("could not close database", "error", closeErr)
+	}
+
+	return err
+}
+
+func drain(srv *http.Server, cfg *apiConfig, cancelRequests context.CancelFunc) error {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err == nil {
+		err = cfg.uploads.wait(shutdownCtx)
+	}
+	if err == nil {
+		slog.Info("all in-flight requests finished")
+		return nil
+	}
+
+	slog.Error("shutdown deadline exceeded, cancelling in-flight requests")
+	cancelRequests()
+
+	graceCtx, cancelGrace := context.WithTimeout(context.Background(), cancelGracePeriod)
+	defer cancelGrace()
+	if err := cfg.uploads.wait(graceCtx); err != nil {
+		slog.Error("uploads still running after cancellation", "error", err)
+	}
+	srv.Close()
+
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/logging"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/validation"
+)
+
+const (
+	maxTagLength    = 32
+	maxTagsPerVideo = 20
+)
+
+// normalizeTag lowercases a tag and joins its words with hyphens, so
+// "Road Trip" and "road-trip" are the same tag.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), "-"))
+}
+
+// normalizeTags normalizes tags and checks the results, reporting field
+// errors against their index in the request's field.
+func normalizeTags(field string, tags []string) ([]string, error) {
+	var errs validation.Errors
+	if len(tags) > maxTagsPerVideo {
+		errs.Check(field, fmt.Sprintf("must have at most %d tags", maxTagsPerVideo))
+	}
+	normalized := make([]string, len(tags))
+	for i, tag := range tags {
+		normalized[i] = normalizeTag(tag)
+		errs.Check(fmt.Sprintf("%s[%d]", field, i),
+			validation.Required(normalized[i]),
+			validation.Length(normalized[i], 1, maxTagLength),
+			tagChars(normalized[i]),
+		)
+	}
+	return normalized, errs.Err()
+}
+
+// tagChars allows letters, digits, hyphens and underscores. Commas in
+// particular would break how tags are read back from the database.
+func tagChars(tag string) string {
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return "must only contain letters, digits, hyphens and underscores"
+		}
+	}
+	return ""
+}
+
+// handlerVideoTagsSet replaces all of a video's tags.
+func (cfg *apiConfig) handlerVideoTagsSet(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Tags []string `json:"tags"`
+	}
+
+	videoID, userID, err := validateRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+
+	params := parameters{}
+	if !decodeJSON(w, r, &params) {
+		return
+	}
+	tags, err := normalizeTags("tags", params.Tags)
+	if err != nil {
+		respondWithValidationError(w, r, err)
+		return
+	}
+
+	video, err := getVideoMetadata(cfg, w, r, videoID, userID)
+	if err != nil {
+		return
+	}
+	err = cfg.db.SetVideoTags(r.Context(), &video, tags)
+	if errors.Is(err, database.ErrNotFound) {
+		respondWithError(w, r, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't set tags", err)
+		return
+	}
+
+	cfg.resolveURLs(&video)
+	w.Header().Set("ETag", videoETag(video))
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// handlerVideoTagDelete removes one tag from a video.
+func (cfg *apiConfig) handlerVideoTagDelete(w http.ResponseWriter, r *http.Request) {
+	videoID, userID, err := validateRequest(cfg, w, r)
+	if err != nil {
+		return
+	}
+	tag := normalizeTag(r.PathValue("tag"))
+
+	video, err := getVideoMetadata(cfg, w, r, videoID, userID)
+	if err != nil {
+		return
+	}
+	removed, err := cfg.db.RemoveVideoTag(r.Context(), &video, tag)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't remove tag", err)
+		return
+	}
+	if !removed {
+		respondWithError(w, r, http.StatusNotFound, "Video doesn't have that tag", nil)
+		return
+	}
+
+	w.Header().Set("ETag", videoETag(video))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerTagsList lists the tags on the caller's videos with how many
+// videos carry each.
+func (cfg *apiConfig) handlerTagsList(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, r, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+	logging.AddAttrs(r.Context(), slog.String("user_id", userID.String()))
+
+	tags, err := cfg.db.GetUserTags(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, r, http.StatusInternalServerError, "Couldn't retrieve tags", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tags)
+}